@@ -66,7 +66,7 @@ func newEchoClient(url, user string, done, limit chan struct{}) error {
 	strRm, _ := json.Marshal(rm)
 	msg := wserver.WSMessage{
 		Kind: wserver.RegisterMessageType,
-		Body: string(strRm),
+		Body: strRm,
 	}
 
 	strMsg, _ := json.Marshal(msg)
@@ -98,7 +98,7 @@ readloop:
 			log.Printf("recv: %s", message)
 			wsm := wserver.WSMessage{
 				Kind: wserver.NormalMessageType,
-				Body: string(message),
+				Body: message,
 			}
 
 			strMsg, _ := json.Marshal(wsm)
@@ -24,10 +24,12 @@ func main() {
 
 	for {
 		for i := range users {
+			// the message is JSON, a string here
+			text, _ := json.Marshal(fmt.Sprintf("Hello user[%s], it is now: %s", users[i], time.Now().Format("2006-01-02 15:04:05.000")))
 			pm := wserver.CommMessage{
 				UserID:  users[i],
 				CommID:  uuid.New().String(),
-				Message: fmt.Sprintf("Hello user[%s], it is now: %s", users[i], time.Now().Format("2006-01-02 15:04:05.000")),
+				Message: text,
 			}
 			b, _ := json.Marshal(pm)
 
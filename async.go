@@ -0,0 +1,157 @@
+package wserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// AsyncPending means the client has not answered the command yet.
+	AsyncPending = "pending"
+	// AsyncDone means the client has answered the command.
+	AsyncDone = "done"
+	// AsyncFailed means the command timed out or its connection was closed.
+	AsyncFailed = "failed"
+)
+
+// asyncResultTTL is how long a finished result can be polled.
+const asyncResultTTL = 5 * time.Minute
+
+// callbackClient posts results of asynchronous commands to callback URLs.
+// Redirects are not followed, they could lead to hosts not allowed.
+var callbackClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// AsyncResult describes the state of an asynchronous command. It's returned
+// by the status endpoint and posted to the callback URL once finished.
+type AsyncResult struct {
+	CommID  string          `json:"commId"`
+	UserID  string          `json:"userId"`
+	Status  string          `json:"status"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Code    string          `json:"code,omitempty"`
+}
+
+// defaultPushCaller identifies the caller of a push request by its
+// Authorization header, it's used if Server.PushCaller is nil.
+func defaultPushCaller(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return hex.EncodeToString(sum[:])
+}
+
+// asyncStore keeps results of asynchronous commands by caller and command ID
+// until they expire. Callers don't see the commands of each other.
+type asyncStore struct {
+	mu      sync.Mutex
+	results map[asyncKey]*AsyncResult
+}
+
+type asyncKey struct {
+	caller string
+	commID string
+}
+
+func newAsyncStore() *asyncStore {
+	return &asyncStore{
+		results: make(map[asyncKey]*AsyncResult),
+	}
+}
+
+// add records a pending command of caller. It fails if the command ID is
+// still known for caller.
+func (as *asyncStore) add(caller, userID, commID string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	key := asyncKey{caller, commID}
+	if _, ok := as.results[key]; ok {
+		return ErrDuplicateCommand
+	}
+	as.results[key] = &AsyncResult{
+		CommID: commID,
+		UserID: userID,
+		Status: AsyncPending,
+	}
+	return nil
+}
+
+// remove forgets a command, it's used when the command can't be pushed.
+func (as *asyncStore) remove(caller, commID string) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	delete(as.results, asyncKey{caller, commID})
+}
+
+// get returns a copy of the result of the command pushed by caller, nil if
+// unknown.
+func (as *asyncStore) get(caller, commID string) *AsyncResult {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	res, ok := as.results[asyncKey{caller, commID}]
+	if !ok {
+		return nil
+	}
+	cp := *res
+	return &cp
+}
+
+// complete records the outcome of the command and schedules its removal.
+func (as *asyncStore) complete(caller, commID string, obj *CommObject, err error) *AsyncResult {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	res, ok := as.results[asyncKey{caller, commID}]
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		res.Status = AsyncFailed
+		res.Error = err.Error()
+		res.Code = errorCode(err)
+	} else {
+		res.Status = AsyncDone
+		res.Message = obj.response.Msg
+		res.Data = obj.response.Data
+	}
+
+	time.AfterFunc(asyncResultTTL, func() {
+		as.remove(caller, commID)
+	})
+
+	cp := *res
+	return &cp
+}
+
+// waitAsync waits for the response of obj in background, then records the
+// result of caller and posts it to callback if not empty.
+func (s *pushHandler) waitAsync(obj *CommObject, caller, userID, callback string) {
+	err := s.wait(obj)
+	s.removeCommand(userID, obj.id)
+
+	res := s.results.complete(caller, obj.id, obj, err)
+	if res == nil || callback == "" {
+		return
+	}
+
+	raw, _ := json.Marshal(res)
+	resp, err := callbackClient.Post(callback, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		log.Println("post async result:", err)
+		return
+	}
+	resp.Body.Close()
+}
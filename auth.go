@@ -0,0 +1,217 @@
+package wserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Status of AuthStatus besides CommStatusOK and CommStatusError, which answer
+// a reauth message.
+const (
+	// AuthStatusExpiring tells the token expires soon.
+	AuthStatusExpiring = "expiring"
+	// AuthStatusRequired tells the server requires a new token, like after
+	// the credentials are revoked.
+	AuthStatusRequired = "required"
+)
+
+// ReauthMessage is sent by the client in a ReauthMessageType message to
+// replace the token it registered with, before the token expires.
+type ReauthMessage struct {
+	Token string `json:"token"`
+}
+
+// AuthStatus tells the client about its token, it's sent in Auth of a
+// CommRequest. Expires is the unix time in milliseconds when the connection
+// is closed unless it reauthenticates, zero if never.
+type AuthStatus struct {
+	Status  string `json:"status"`
+	Expires int64  `json:"expires,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Claims returns the claims of the user given by Server.AuthRequest or
+// Server.VerifyToken, nil if the connection is not authenticated by them.
+// They're replaced when the client reauthenticates.
+func (c *Conn) Claims() map[string]interface{} {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	return c.claims
+}
+
+// HandleReauth verifies the new token of the client, which must be of the user
+// registered. The connection then expires with the new token. The client is
+// answered either way, a connection failing to reauthenticate is still closed
+// when the old token expires only.
+//
+// Reauth fails with ErrUnauthorized if tokens can't be verified, that is
+// neither Server.VerifyToken nor Server.AuthToken is set. A connection
+// authenticated by Server.AuthRequest is verified by Server.VerifyToken only,
+// so it fails without it, and the client is not told to reauthenticate then.
+func (c *Conn) HandleReauth(body string) error {
+	err := c.reauth(body)
+
+	status := &AuthStatus{Status: CommStatusOK}
+	if err != nil {
+		status = &AuthStatus{Status: CommStatusError, Code: errorCode(err), Error: err.Error()}
+	}
+	c.authMu.Lock()
+	status.Expires = c.expires()
+	c.authMu.Unlock()
+
+	if werr := c.writeAuthStatus(status); werr != nil {
+		log.Println("write auth status:", werr)
+	}
+	return err
+}
+
+func (c *Conn) reauth(body string) error {
+	rm := ReauthMessage{}
+	if err := json.Unmarshal([]byte(body), &rm); err != nil {
+		return fmt.Errorf("%w: %v", ErrRequestIllegal, err)
+	}
+
+	if c.userId == nil {
+		return ErrNotRegistered
+	}
+
+	wh := c.wh
+	var userID string
+	var claims map[string]interface{}
+	if wh.verifyToken != nil {
+		uID, cl, err := wh.verifyToken(rm.Token)
+		if err != nil {
+			return err
+		}
+		userID, claims = uID, cl
+	} else if c.authenticated {
+		// the upgrade request can't be presented again
+		return fmt.Errorf("%w: authenticated by the upgrade request", ErrUnauthorized)
+	} else if wh.calcUserIDFunc != nil {
+		uID, ok := wh.calcUserIDFunc(rm.Token)
+		if !ok {
+			return ErrInvalidToken
+		}
+		userID = uID
+	} else {
+		// the token would be taken as the userID
+		return fmt.Errorf("%w: tokens are not verified", ErrUnauthorized)
+	}
+
+	if userID != *c.userId {
+		return fmt.Errorf("%w: token of another user", ErrInvalidToken)
+	}
+	c.setClaims(claims)
+	return nil
+}
+
+// setClaims replaces the claims of the connection, which expires as their
+// "exp" claim, or never if it's not given.
+func (c *Conn) setClaims(claims map[string]interface{}) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	c.claims = claims
+	exp, ok := claimTime(claims, "exp")
+	if !ok {
+		c.stopExpiryLocked()
+		return
+	}
+	c.expireAtLocked(exp, true)
+}
+
+// requireReauth tells ProtocolVersion2 clients to reauthenticate, and closes
+// the connection after grace unless it does. The expiry of the current token
+// is kept if it's earlier.
+func (c *Conn) requireReauth(grace time.Duration) {
+	c.authMu.Lock()
+	exp := time.Now().Add(grace)
+	if !c.expiryAt.IsZero() && c.expiryAt.Before(exp) {
+		exp = c.expiryAt
+	}
+	c.expireAtLocked(exp, false)
+	c.authMu.Unlock()
+
+	if c.version >= ProtocolVersion2 && c.canReauth() {
+		c.writeAuthStatus(&AuthStatus{
+			Status:  AuthStatusRequired,
+			Expires: exp.UnixNano() / int64(time.Millisecond),
+		})
+	}
+}
+
+// expireAtLocked closes the connection with websocket.ClosePolicyViolation
+// at exp, and tells the client it's expiring before if notice is true. It
+// replaces the expiry set before. It must be called with c.authMu held.
+func (c *Conn) expireAtLocked(exp time.Time, notice bool) {
+	c.stopExpiryLocked()
+
+	c.expiryAt = exp
+	c.expiry = time.AfterFunc(time.Until(exp), func() {
+		c.CloseWithReason(websocket.ClosePolicyViolation, CodeTokenExpired)
+	})
+
+	if !notice || c.version < ProtocolVersion2 || !c.canReauth() {
+		return
+	}
+	c.expiring = time.AfterFunc(time.Until(exp.Add(-c.wh.reauthNotice)), func() {
+		c.writeAuthStatus(&AuthStatus{
+			Status:  AuthStatusExpiring,
+			Expires: exp.UnixNano() / int64(time.Millisecond),
+		})
+	})
+}
+
+// canReauth reports whether the token of a reauth message can be verified,
+// see HandleReauth. Clients are told to reauthenticate only if it can.
+func (c *Conn) canReauth() bool {
+	if c.wh.verifyToken != nil {
+		return true
+	}
+	return !c.authenticated && c.wh.calcUserIDFunc != nil
+}
+
+// stopExpiry stops the timers of the token, the connection never expires
+// then.
+func (c *Conn) stopExpiry() {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	c.stopExpiryLocked()
+}
+
+func (c *Conn) stopExpiryLocked() {
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if c.expiring != nil {
+		c.expiring.Stop()
+		c.expiring = nil
+	}
+	c.expiryAt = time.Time{}
+}
+
+// expires returns the expiry in unix milliseconds, zero if none. It must be
+// called with c.authMu held.
+func (c *Conn) expires() int64 {
+	if c.expiryAt.IsZero() {
+		return 0
+	}
+	return c.expiryAt.UnixNano() / int64(time.Millisecond)
+}
+
+func (c *Conn) writeAuthStatus(status *AuthStatus) error {
+	p, err := c.codec.Marshal(&CommRequest{Auth: status})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(p)
+	return err
+}
@@ -0,0 +1,107 @@
+package wserver
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// BroadcastMessage defines message struct send by client to push a command to
+// several users at once. The command is sent to every connected user if All
+// is true, otherwise to the users in UserIDs. Other fields have the same
+// meaning as in CommMessage.
+type BroadcastMessage struct {
+	UserIDs []string        `json:"userIds,omitempty"`
+	All     bool            `json:"all,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	CommID  string          `json:"commId"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+	Timeout int64           `json:"timeout,omitempty"`
+	Mode    string          `json:"mode,omitempty"`
+}
+
+// broadcastHandler defines to handle broadcast and multicast request.
+type broadcastHandler struct {
+	// authFunc defines to authorize request. The request will proceed only
+	// when it returns true.
+	authFunc func(r *http.Request) bool
+	ph       *pushHandler
+}
+
+// Authorize if needed. Then push the command to each user and respond a JSON
+// object with a PushResult by userID once all of them answered or timed out.
+func (bh *broadcastHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	// authorize
+	if bh.authFunc != nil {
+		if ok := bh.authFunc(r); !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+	}
+
+	var msg BroadcastMessage
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&msg); err != nil {
+		writeError(w, ErrRequestIllegal)
+		return
+	}
+
+	if (!msg.All && len(msg.UserIDs) == 0) || msg.CommID == "" ||
+		msg.Timeout < 0 || !checkMode(msg.Mode) || (content{msg: msg.Message, data: msg.Data}).empty() {
+		writeError(w, ErrRequestIllegal)
+		return
+	}
+
+	// authorize the command for every user at once, or for each of them
+	authorize := func(userID string) error {
+		return bh.ph.authorize(r, &CommMessage{UserID: userID, Event: msg.Event, CommID: msg.CommID,
+			Message: msg.Message, Data: msg.Data, Timeout: msg.Timeout, Mode: msg.Mode})
+	}
+
+	var userIDs []string
+	if msg.All {
+		if err := authorize(""); err != nil {
+			writeError(w, err)
+			return
+		}
+		userIDs = dedup(bh.ph.cm.users(msg.Event))
+	} else {
+		userIDs = dedup(msg.UserIDs)
+		for _, userID := range userIDs {
+			if err := authorize(userID); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+	}
+	// charged once every user is allowed
+	if err := bh.ph.charge(r, len(userIDs)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	timeout := bh.ph.commandTimeout(msg.Timeout, false)
+	results := bh.ph.pushMany(userIDs, msg.CommID, content{msg: msg.Message, data: msg.Data}, msg.Mode, msg.Event, timeout)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// dedup removes duplicated and empty userIDs, keeping the order.
+func dedup(userIDs []string) []string {
+	seen := make(map[string]struct{}, len(userIDs))
+	out := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := seen[userID]; ok || userID == "" {
+			continue
+		}
+		seen[userID] = struct{}{}
+		out = append(out, userID)
+	}
+	return out
+}
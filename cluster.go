@@ -0,0 +1,355 @@
+package wserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// BrokerCommand is a command relayed to the node owning the user.
+type BrokerCommand struct {
+	// From is the node waiting for the response.
+	From string `json:"from"`
+
+	UserID  string          `json:"userId"`
+	Event   string          `json:"event,omitempty"`
+	CommID  string          `json:"commId"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+	Mode    string          `json:"mode,omitempty"`
+
+	// Timeout in milliseconds.
+	Timeout int64 `json:"timeout"`
+
+	// NoReply is true if the response is not waited.
+	NoReply bool `json:"noReply,omitempty"`
+}
+
+// BrokerResponse is the response of a BrokerCommand relayed back to the node
+// waiting for it.
+type BrokerResponse struct {
+	// From is the node owning the user.
+	From string `json:"from"`
+
+	UserID string `json:"userId"`
+	CommID string `json:"commId"`
+
+	// Messages are the responses of the connections, there are more than
+	// one only in PushAll mode.
+	Messages []json.RawMessage `json:"messages,omitempty"`
+	Data     [][]byte          `json:"data,omitempty"`
+
+	// Legacy is true if the messages are sent by a ProtocolVersion1 client.
+	Legacy bool `json:"legacy,omitempty"`
+
+	// Error and Code describe the failure of the command, Code is one of
+	// the codes of ErrorResponse. ClientCode is set for a ClientError.
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"`
+	ClientCode string `json:"clientCode,omitempty"`
+}
+
+// BrokerHandler handles messages delivered to the inbox of a node. Methods
+// are called from the goroutine of the Broker, so they must not block.
+type BrokerHandler interface {
+	HandleCommand(cmd *BrokerCommand)
+	HandleResponse(resp *BrokerResponse)
+}
+
+// Broker relays commands and responses between nodes of a cluster, so that a
+// push accepted by any node reaches the node the user is connected to.
+type Broker interface {
+	// PublishCommand sends cmd to the inbox of node, or to the inbox of
+	// every node if node is empty.
+	PublishCommand(node string, cmd *BrokerCommand) error
+
+	// PublishResponse sends resp to the inbox of node.
+	PublishResponse(node string, resp *BrokerResponse) error
+
+	// Subscribe delivers messages sent to the inbox of node to h until
+	// cancel is called.
+	Subscribe(node string, h BrokerHandler) (cancel func(), err error)
+}
+
+// cluster routes commands for users not connected to this node through the
+// broker, and executes commands routed to this node.
+type cluster struct {
+	node   string
+	broker Broker
+	ph     *pushHandler
+
+	// presence locates the node of a user, it's shared by the nodes.
+	presence PresenceStore
+
+	mu sync.Mutex
+	// pending are the commands sent to other nodes and waiting for their
+	// response, by userID and commID.
+	pending map[clusterKey]*CommObject
+	cancel  func()
+}
+
+type clusterKey struct {
+	userID string
+	commID string
+}
+
+func newCluster(node string, broker Broker, ph *pushHandler, presence PresenceStore) (*cluster, error) {
+	c := &cluster{
+		node:     node,
+		broker:   broker,
+		ph:       ph,
+		presence: presence,
+		pending:  make(map[clusterKey]*CommObject),
+	}
+
+	cancel, err := broker.Subscribe(node, c)
+	if err != nil {
+		return nil, err
+	}
+	c.cancel = cancel
+
+	return c, nil
+}
+
+// push publishes the command to other nodes. The returned CommObject is
+// finished when the owning node responds.
+func (c *cluster) push(userID, commID string, body content, mode, event string, timeout time.Duration) (*CommObject, error) {
+	node, err := c.locate(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := clusterKey{userID, commID}
+	obj := &CommObject{
+		id:      commID,
+		mode:    mode,
+		start:   time.Now(),
+		timeout: timeout,
+		waitCH:  make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	if _, ok := c.pending[key]; ok {
+		c.mu.Unlock()
+		return nil, ErrDuplicateCommand
+	}
+	c.pending[key] = obj
+	c.mu.Unlock()
+
+	cmd := &BrokerCommand{
+		From:    c.node,
+		UserID:  userID,
+		Event:   event,
+		CommID:  commID,
+		Message: body.msg,
+		Data:    body.data,
+		Mode:    mode,
+		Timeout: int64(timeout / time.Millisecond),
+		NoReply: body.noReply,
+	}
+	if err := c.broker.PublishCommand(node, cmd); err != nil {
+		c.remove(userID, commID)
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// locate returns the node the user is connected to, or empty if the command
+// must be published to every node. It fails with ErrUserNotConnected if presence
+// knows the user is connected nowhere.
+func (c *cluster) locate(userID string) (string, error) {
+	entries, err := c.presence.Lookup(userID)
+	if err != nil {
+		log.Println("lookup presence:", err)
+		return "", nil
+	}
+
+	node := ""
+	for _, e := range entries {
+		if e.Node == c.node {
+			// unbound from this node meanwhile
+			continue
+		}
+		if node != "" && node != e.Node {
+			// connected to several nodes
+			return "", nil
+		}
+		node = e.Node
+	}
+	if node == "" {
+		return "", ErrUserNotConnected
+	}
+	return node, nil
+}
+
+// remove forgets the command sent to other nodes.
+func (c *cluster) remove(userID, commID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, clusterKey{userID, commID})
+}
+
+// HandleCommand executes the command if the user is connected to this node,
+// and publishes the response to the node waiting for it.
+func (c *cluster) HandleCommand(cmd *BrokerCommand) {
+	if cmd.From == c.node {
+		return
+	}
+
+	go func() {
+		timeout := time.Duration(cmd.Timeout) * time.Millisecond
+		body := content{msg: cmd.Message, data: cmd.Data, noReply: cmd.NoReply}
+		obj, err := c.ph.pushLocal(cmd.UserID, cmd.CommID, body, cmd.Mode, cmd.Event, timeout)
+		if errors.Is(err, ErrUserNotConnected) {
+			// the user is connected to another node, or subscribed there
+			return
+		}
+		if cmd.NoReply {
+			if err == nil {
+				c.ph.cm.removeCommand(cmd.UserID, cmd.CommID)
+			}
+			return
+		}
+
+		resp := &BrokerResponse{
+			From:   c.node,
+			UserID: cmd.UserID,
+			CommID: cmd.CommID,
+		}
+		if err == nil {
+			err = c.ph.wait(obj)
+			c.ph.cm.removeCommand(cmd.UserID, cmd.CommID)
+		}
+		var ce *ClientError
+		if errors.As(err, &ce) {
+			resp.Error = ce.Message
+			resp.Code = CodeClientError
+			resp.ClientCode = ce.Code
+		} else if err != nil {
+			resp.Error = err.Error()
+			resp.Code = errorCode(err)
+		} else {
+			obj.mu.Lock()
+			for _, r := range obj.responses {
+				resp.Messages = append(resp.Messages, r.Msg)
+				resp.Data = append(resp.Data, r.Data)
+			}
+			resp.Legacy = obj.response.legacy
+			obj.mu.Unlock()
+		}
+
+		if err := c.broker.PublishResponse(cmd.From, resp); err != nil {
+			log.Println("publish response:", err)
+		}
+	}()
+}
+
+// HandleResponse finishes the command waiting for resp.
+func (c *cluster) HandleResponse(resp *BrokerResponse) {
+	c.mu.Lock()
+	obj, ok := c.pending[clusterKey{resp.UserID, resp.CommID}]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if resp.Code == CodeClientError {
+		obj.finish(nil, &ClientError{Code: resp.ClientCode, Message: resp.Error})
+		return
+	}
+	if resp.Error != "" {
+		obj.finish(nil, codeError(resp.Code, resp.Error))
+		return
+	}
+	if len(resp.Messages) == 0 {
+		obj.finish(nil, errors.New("empty response from node "+resp.From))
+		return
+	}
+
+	obj.mu.Lock()
+	for i, msg := range resp.Messages {
+		r := &CommResponse{Id: resp.CommID, Msg: msg, legacy: resp.Legacy}
+		if i < len(resp.Data) {
+			r.Data = resp.Data[i]
+		}
+		obj.responses = append(obj.responses, r)
+	}
+	first := obj.responses[0]
+	obj.mu.Unlock()
+	obj.finish(first, nil)
+}
+
+// close unsubscribes from the broker and fails the commands waiting for
+// other nodes with err.
+func (c *cluster) close(err error) {
+	c.cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, obj := range c.pending {
+		obj.finish(nil, err)
+		delete(c.pending, key)
+	}
+}
+
+// MemoryBroker is a Broker relaying messages between servers in the same
+// process. It's mostly useful for tests.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers map[string]BrokerHandler
+}
+
+// NewMemoryBroker creates a new MemoryBroker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		handlers: make(map[string]BrokerHandler),
+	}
+}
+
+// PublishCommand implements Broker.
+func (b *MemoryBroker) PublishCommand(node string, cmd *BrokerCommand) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for n, h := range b.handlers {
+		if node == "" || n == node {
+			c := *cmd
+			go h.HandleCommand(&c)
+		}
+	}
+	return nil
+}
+
+// PublishResponse implements Broker.
+func (b *MemoryBroker) PublishResponse(node string, resp *BrokerResponse) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if h, ok := b.handlers[node]; ok {
+		r := *resp
+		go h.HandleResponse(&r)
+	}
+	return nil
+}
+
+// Subscribe implements Broker.
+func (b *MemoryBroker) Subscribe(node string, h BrokerHandler) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.handlers[node]; ok {
+		return nil, errors.New("node already subscribed")
+	}
+	b.handlers[node] = h
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, node)
+	}, nil
+}
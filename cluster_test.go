@@ -0,0 +1,421 @@
+package wserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func Test_Cluster_MemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	presence := NewMemoryPresence()
+	testCluster(t, broker, broker, presence, presence)
+}
+
+func Test_Cluster_RedisBroker(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	testCluster(t, NewRedisBroker(fr.Addr()), NewRedisBroker(fr.Addr()),
+		NewRedisPresence(fr.Addr()), NewRedisPresence(fr.Addr()))
+}
+
+func Test_Cluster_NoPresence(t *testing.T) {
+	s := NewServer("")
+	s.Broker = NewMemoryBroker()
+	if _, err := s.Handler(); err == nil {
+		t.Fatal("broker without presence accepted")
+	}
+}
+
+// testCluster runs two nodes, the user connects to node b and is pushed
+// through node a.
+func testCluster(t *testing.T, ba, bb Broker, pa, pb PresenceStore) {
+	a := NewServer("")
+	a.Broker = ba
+	a.Presence = pa
+	a.NodeID = "a"
+	a.PushTimeout = 300 * time.Millisecond
+	tsa := newTestServer(a)
+	defer tsa.Close()
+	defer a.Shutdown(context.Background())
+
+	b := NewServer("")
+	b.Broker = bb
+	b.Presence = pb
+	b.NodeID = "b"
+	tsb := newTestServer(b)
+	defer tsb.Close()
+	defer b.Shutdown(context.Background())
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, b, tsb, userID, "")
+	defer c.Close()
+	go echoCommands(c)
+
+	push := func(userID, event string) (int, string) {
+		body, _ := json.Marshal(CommMessage{
+			UserID:  userID,
+			Event:   event,
+			CommID:  uuid.New().String(),
+			Message: jsonString("across nodes"),
+		})
+		resp, err := http.Post(tsa.URL+a.PushPath, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, got := push(userID, ""); code != http.StatusOK || got != "across nodes" {
+		t.Fatalf("push through node a: %d %s", code, got)
+	}
+	// fails at once, without waiting for the nodes
+	start := time.Now()
+	if code, _ := push("nobody", ""); code != http.StatusNotFound || time.Since(start) >= a.PushTimeout {
+		t.Fatalf("push to unknown user: %d after %v", code, time.Since(start))
+	}
+
+	// connected to both nodes, but subscribed to the event on node b only
+	other := uuid.New().String()
+	ca := dialAndRegister(t, a, tsa, other, "")
+	defer ca.Close()
+	cb := dialAndRegister(t, b, tsb, other, "news")
+	defer cb.Close()
+	go echoCommands(cb)
+	if code, got := push(other, "news"); code != http.StatusOK || got != "across nodes" {
+		t.Fatalf("push to the event subscribed on node b: %d %s", code, got)
+	}
+}
+
+func Test_RedisBroker_CancelReconnecting(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	cancel, err := NewRedisBroker(fr.Addr()).Subscribe("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the broker dials again once its connection is broken, and is
+	// cancelled while subscribing
+	reached := make(chan struct{})
+	release := make(chan struct{})
+	fr.mu.Lock()
+	fr.onSubscribe = func() {
+		close(reached)
+		<-release
+	}
+	for _, conns := range fr.subs {
+		for c := range conns {
+			c.Close()
+		}
+	}
+	fr.mu.Unlock()
+	<-reached
+
+	cancelled := make(chan struct{})
+	go func() {
+		cancel()
+		close(cancelled)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancel hangs")
+	}
+}
+
+func Test_Presence_Memory(t *testing.T) {
+	testPresence(t, NewMemoryPresence())
+}
+
+func Test_Presence_Redis(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	testPresence(t, NewRedisPresence(fr.Addr()))
+}
+
+// testPresence runs two nodes sharing store and allowing one session per
+// user. The user connected to node b can't register on node a, and is pushed
+// through node a.
+func testPresence(t *testing.T, store PresenceStore) {
+	broker := NewMemoryBroker()
+
+	a := NewServer("")
+	a.Broker = broker
+	a.Presence = store
+	a.NodeID = "a"
+	a.MaxConnsPerUser = 1
+	tsa := newTestServer(a)
+	defer tsa.Close()
+	defer a.Shutdown(context.Background())
+
+	b := NewServer("")
+	b.Broker = broker
+	b.Presence = store
+	b.NodeID = "b"
+	b.MaxConnsPerUser = 1
+	tsb := newTestServer(b)
+	defer tsb.Close()
+	defer b.Shutdown(context.Background())
+
+	userID := uuid.New().String()
+	cb := dialAndRegister(t, b, tsb, userID, "")
+	go echoCommands(cb)
+
+	entries, err := store.Lookup(userID)
+	if err != nil || len(entries) != 1 || entries[0].Node != "b" {
+		t.Fatalf("lookup after register on b: %v %v", entries, err)
+	}
+
+	// one session per user across the nodes
+	ca := dialAndRegister(t, a, tsa, userID, "")
+	defer ca.Close()
+	if found, _ := a.wh.cm.hasUser(userID); found {
+		t.Fatal("user should not register on node a while connected to node b")
+	}
+
+	obj, err := a.Push(userID, "", "located")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ph.wait(obj); err != nil || string(payload(obj.response.Msg)) != "located" {
+		t.Fatalf("push through node a: %v", err)
+	}
+	a.ph.removeCommand(userID, obj.id)
+
+	// the lease is released with the connection
+	cb.Close()
+	waitConns(t, b, userID, 0)
+	for i := 0; ; i++ {
+		entries, _ := store.Lookup(userID)
+		if len(entries) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("lookup after close: %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := a.Push(userID, "", "nobody"); err != ErrUserNotConnected {
+		t.Fatalf("push to user connected nowhere: %v", err)
+	}
+
+	ca2 := dialAndRegister(t, a, tsa, userID, "")
+	defer ca2.Close()
+	waitConns(t, a, userID, 1)
+}
+
+func Test_Presence_Lease(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+
+	for _, store := range []PresenceStore{NewMemoryPresence(), NewRedisPresence(fr.Addr())} {
+		userID := uuid.New().String()
+		if err := store.Register(userID, "dead", "c1", 1, 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Register(userID, "alive", "c2", 1, time.Minute); err != ErrAlreadyRegistered {
+			t.Fatalf("register over max: %v", err)
+		}
+
+		// the dead node stops renewing its lease
+		time.Sleep(100 * time.Millisecond)
+		if entries, _ := store.Lookup(userID); len(entries) != 0 {
+			t.Fatalf("lookup after expiry: %v", entries)
+		}
+		if err := store.Register(userID, "alive", "c2", 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Renew(userID, "alive", "c2", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := store.Lookup(userID)
+		if err != nil || len(entries) != 1 || entries[0].Node != "alive" || entries[0].ConnID != "c2" {
+			t.Fatalf("lookup after register: %v %v", entries, err)
+		}
+	}
+}
+
+// fakeRedis is a stand-in Redis server speaking enough of the protocol for
+// the tests.
+type fakeRedis struct {
+	l net.Listener
+
+	mu    sync.Mutex
+	subs  map[string]map[net.Conn]struct{}
+	zsets map[string]map[string]float64
+
+	// onSubscribe is called before each SUBSCRIBE if it's set
+	onSubscribe func()
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := &fakeRedis{
+		l:     l,
+		subs:  make(map[string]map[net.Conn]struct{}),
+		zsets: make(map[string]map[string]float64),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) Addr() string {
+	return fr.l.Addr().String()
+}
+
+func (fr *fakeRedis) Close() error {
+	return fr.l.Close()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	defer fr.unsubscribe(conn)
+
+	rc := &respConn{conn: conn, r: bufio.NewReader(conn)}
+	for {
+		reply, err := rc.receive()
+		if err != nil {
+			return
+		}
+		arr, _ := reply.([]interface{})
+		args := make([]string, len(arr))
+		for i, a := range arr {
+			b, _ := a.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		fr.mu.Lock()
+		onSubscribe := fr.onSubscribe
+		fr.mu.Unlock()
+		if onSubscribe != nil && strings.ToUpper(args[0]) == "SUBSCRIBE" {
+			onSubscribe()
+		}
+
+		fr.mu.Lock()
+		out := fr.exec(conn, strings.ToUpper(args[0]), args[1:])
+		fr.mu.Unlock()
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a command with fr.mu held and returns the encoded reply.
+func (fr *fakeRedis) exec(conn net.Conn, cmd string, args []string) string {
+	switch cmd {
+	case "SUBSCRIBE":
+		out := ""
+		for i, ch := range args {
+			if fr.subs[ch] == nil {
+				fr.subs[ch] = make(map[net.Conn]struct{})
+			}
+			fr.subs[ch][conn] = struct{}{}
+			out += "*3\r\n" + bulk("subscribe") + bulk(ch) + ":" + strconv.Itoa(i+1) + "\r\n"
+		}
+		return out
+	case "PUBLISH":
+		msg := "*3\r\n" + bulk("message") + bulk(args[0]) + bulk(args[1])
+		for c := range fr.subs[args[0]] {
+			c.Write([]byte(msg))
+		}
+		return ":" + strconv.Itoa(len(fr.subs[args[0]])) + "\r\n"
+	case "ZADD":
+		if fr.zsets[args[0]] == nil {
+			fr.zsets[args[0]] = make(map[string]float64)
+		}
+		score, _ := strconv.ParseFloat(args[1], 64)
+		fr.zsets[args[0]][args[2]] = score
+		return ":1\r\n"
+	case "ZREM":
+		delete(fr.zsets[args[0]], args[1])
+		return ":1\r\n"
+	case "ZCARD":
+		return ":" + strconv.Itoa(len(fr.zsets[args[0]])) + "\r\n"
+	case "ZREMRANGEBYSCORE":
+		n := 0
+		for m, score := range fr.zsets[args[0]] {
+			if inRange(score, args[1], args[2]) {
+				delete(fr.zsets[args[0]], m)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "ZRANGEBYSCORE":
+		out, n := "", 0
+		for m, score := range fr.zsets[args[0]] {
+			if inRange(score, args[1], args[2]) {
+				out += bulk(m) + bulk(strconv.FormatFloat(score, 'f', -1, 64))
+				n += 2
+			}
+		}
+		return "*" + strconv.Itoa(n) + "\r\n" + out
+	case "PEXPIRE":
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func (fr *fakeRedis) unsubscribe(conn net.Conn) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	for _, conns := range fr.subs {
+		delete(conns, conn)
+	}
+}
+
+// inRange reports whether score is between min and max given like the
+// arguments of ZRANGEBYSCORE.
+func inRange(score float64, min, max string) bool {
+	bound := func(s string) (float64, bool) {
+		exclusive := strings.HasPrefix(s, "(")
+		v, _ := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+		return v, exclusive
+	}
+
+	lo, loEx := bound(min)
+	hi, hiEx := bound(max)
+	if score < lo || (loEx && score == lo) {
+		return false
+	}
+	return score < hi || (!hiEx && score == hi)
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
@@ -0,0 +1,123 @@
+package wserver
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec encodes the messages exchanged with the client. It's negotiated by
+// the websocket subprotocol, clients asking for none use JSONCodec.
+type Codec interface {
+	// Name is the websocket subprotocol selecting the codec, like
+	// "wserver.json".
+	Name() string
+
+	// MessageType is the type of frames written to the client,
+	// websocket.TextMessage or websocket.BinaryMessage.
+	MessageType() int
+
+	// Marshal encodes v sent to the client, which is *CommRequest or
+	// *WSMessage.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data sent by the client into wm. Body of wm must be
+	// JSON, so it's converted if the codec encodes it otherwise.
+	Unmarshal(data []byte, wm *WSMessage) error
+}
+
+// JSONCodec encodes messages as JSON in text frames. It's the default one.
+type JSONCodec struct{}
+
+// Name implements Codec.
+func (JSONCodec) Name() string {
+	return "wserver.json"
+}
+
+// MessageType implements Codec.
+func (JSONCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+// Marshal implements Codec.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (JSONCodec) Unmarshal(data []byte, wm *WSMessage) error {
+	return json.Unmarshal(data, wm)
+}
+
+// requestEncoder encodes a request for connections, once for each codec and
+// protocol version.
+type requestEncoder struct {
+	request *CommRequest
+	cache   map[requestEncoding][]byte
+}
+
+type requestEncoding struct {
+	codec  string
+	legacy bool
+}
+
+func newRequestEncoder(request *CommRequest) *requestEncoder {
+	return &requestEncoder{
+		request: request,
+		cache:   make(map[requestEncoding][]byte),
+	}
+}
+
+// encode returns the request encoded by the codec of conn, with message as
+// JSON string for ProtocolVersion1 clients.
+func (e *requestEncoder) encode(conn *Conn) ([]byte, error) {
+	key := requestEncoding{conn.codec.Name(), conn.version < ProtocolVersion2}
+	if p, ok := e.cache[key]; ok {
+		return p, nil
+	}
+
+	r := *e.request
+	if key.legacy && len(r.Msg) > 0 {
+		r.Msg = textMessage(r.Msg)
+	}
+	p, err := conn.codec.Marshal(&r)
+	if err != nil {
+		return nil, err
+	}
+	e.cache[key] = p
+	return p, nil
+}
+
+// defaultCodecs are the codecs of Server if Codecs is empty.
+func defaultCodecs() []Codec {
+	return []Codec{JSONCodec{}, MsgPackCodec{}, ProtoCodec{}}
+}
+
+// negotiate returns the codec of the subprotocol, the first of codecs if
+// it's not one of them.
+func negotiate(codecs []Codec, subprotocol string) Codec {
+	for _, c := range codecs {
+		if c.Name() == subprotocol {
+			return c
+		}
+	}
+	return codecs[0]
+}
+
+// withSubprotocols returns a copy of u accepting the subprotocols of codecs
+// as well as its own ones.
+func withSubprotocols(u *websocket.Upgrader, codecs []Codec) *websocket.Upgrader {
+	cp := *u
+	cp.Subprotocols = append([]string(nil), u.Subprotocols...)
+
+NextCodec:
+	for _, c := range codecs {
+		for _, p := range cp.Subprotocols {
+			if p == c.Name() {
+				continue NextCodec
+			}
+		}
+		cp.Subprotocols = append(cp.Subprotocols, c.Name())
+	}
+	return &cp
+}
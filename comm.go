@@ -1,11 +1,28 @@
 package wserver
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 )
 
+// Push modes decide which connections of a user a command is sent to.
+const (
+	// PushNewest sends the command to the connection registered most
+	// recently. It's the default mode.
+	PushNewest = "newest"
+	// PushFirst sends the command to all connections of the user, and the
+	// first response wins.
+	PushFirst = "first"
+	// PushAll sends the command to all connections of the user, and waits
+	// for all of them to respond.
+	PushAll = "all"
+)
+
 // one command, has several properties
 // 1. async or sync
 // 2. expire
@@ -16,34 +33,243 @@ type CommObject struct {
 
 	async bool
 
+	// mode is one of PushNewest, PushFirst and PushAll.
+	mode string
+
 	start   time.Time
 	timeout time.Duration
 
-	request  *CommRequest
-	response *CommResponse
-	waitCH   chan struct{}
+	request   *CommRequest
+	response  *CommResponse
+	responses []*CommResponse
+	err       error
+	waitCH    chan struct{}
+	done      sync.Once
+
+	// mu guards conns and responses.
+	mu sync.Mutex
+
+	// conns are the connections the request is sent to and whose response
+	// is still waited.
+	conns []*Conn
+}
+
+// deadline returns the time when waiting for the response gives up.
+func (o *CommObject) deadline() time.Time {
+	return o.start.Add(o.timeout)
+}
+
+// finish resolves the command with either a response or an error, then wakes
+// up whoever waits on it. Only the first call takes effect.
+func (o *CommObject) finish(resp *CommResponse, err error) {
+	o.done.Do(func() {
+		o.response = resp
+		o.err = err
+		close(o.waitCH)
+	})
+}
+
+// respond records the response sent by conn. The command is finished by the
+// first response, or by the last one if it's pushed in PushAll mode.
+func (o *CommObject) respond(conn *Conn, cr *CommResponse) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.removeConn(conn) {
+		return errors.New("command is not waiting for this connection")
+	}
+	o.responses = append(o.responses, cr)
+
+	if o.mode != PushAll || len(o.conns) == 0 {
+		o.finish(o.result())
+	}
+	return nil
+}
+
+// detach stops waiting for the response of conn. The command fails with err
+// if no connection is left and nobody has responded.
+func (o *CommObject) detach(conn *Conn, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.removeConn(conn) || len(o.conns) > 0 {
+		return
+	}
+	if len(o.responses) > 0 {
+		o.finish(o.result())
+	} else {
+		o.finish(nil, err)
+	}
+}
+
+// result returns the first response and the error it reports. In PushAll
+// mode, the command fails if any of the responses reports an error. It must
+// be called with o.mu held and at least one response.
+func (o *CommObject) result() (*CommResponse, error) {
+	first := o.responses[0]
+	if o.mode != PushAll {
+		return first, first.err()
+	}
+	for _, r := range o.responses {
+		if err := r.err(); err != nil {
+			return first, err
+		}
+	}
+	return first, nil
+}
+
+// waiting reports whether the response of conn is still waited.
+func (o *CommObject) waiting(conn *Conn) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, c := range o.conns {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
 
-	conn *Conn
+// removeConn removes conn from the waited connections, it returns false if
+// conn is not found.
+func (o *CommObject) removeConn(conn *Conn) bool {
+	for i, c := range o.conns {
+		if c == conn {
+			o.conns = append(o.conns[:i:i], o.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
+// CommRequest is the command sent to the client. Timeout is in milliseconds
+// and Deadline is the unix time in milliseconds after which the response is
+// no longer waited, so the client can abandon the expired work.
+//
+// Msg is the JSON value pushed, ProtocolVersion1 clients receive it as a
+// JSON string. Data is the binary data pushed instead, it's base64 encoded
+// in JSON. If NoReply is true, the server doesn't wait for a response.
+//
+// A CommRequest with Reply, Register or Auth set is no command but the reply
+// to a Request, the register message or the token of the client, it needs no
+// response.
 type CommRequest struct {
-	Id  string `json:"id"`
-	Msg string `json:"msg"`
+	Id       string          `json:"id"`
+	Msg      json.RawMessage `json:"msg,omitempty"`
+	Timeout  int64           `json:"timeout,omitempty"`
+	Deadline int64           `json:"deadline,omitempty"`
+	Data     []byte          `json:"data,omitempty"`
+	NoReply  bool            `json:"noReply,omitempty"`
+	Reply    *Reply          `json:"reply,omitempty"`
+	Register *RegisterResult `json:"register,omitempty"`
+	Auth     *AuthStatus     `json:"auth,omitempty"`
 }
 
+// Status of CommResponse.
+const (
+	CommStatusOK    = "ok"
+	CommStatusError = "error"
+)
+
+// CommResponse is the response of the client to a CommRequest. A client
+// failing to execute the command sets Status to CommStatusError, and
+// describes the failure by Code and Error. The push then fails with a
+// ClientError. Status can be omitted if the command succeeds.
+//
+// Msg is any JSON value, ProtocolVersion1 clients respond it as a JSON
+// string. Data is binary data responded instead.
 type CommResponse struct {
-	Id  string `json:"id"`
-	Msg string `json:"msg"`
+	Id     string          `json:"id"`
+	Msg    json.RawMessage `json:"msg,omitempty"`
+	Status string          `json:"status,omitempty"`
+	Code   string          `json:"code,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Data   []byte          `json:"data,omitempty"`
+
+	// legacy is true if it's sent by a ProtocolVersion1 client, so Msg is
+	// returned as text to the pusher.
+	legacy bool
+}
+
+// err returns the ClientError reported by the response, nil if it succeeds.
+func (r *CommResponse) err() error {
+	if r.Status != CommStatusError && r.Error == "" {
+		return nil
+	}
+	return &ClientError{Code: r.Code, Message: r.Error}
+}
+
+// content is what a command carries, a JSON message or binary data, and
+// whether a response is waited for it.
+type content struct {
+	msg     json.RawMessage
+	data    []byte
+	noReply bool
+}
+
+// empty reports whether c carries nothing, or both a message and data.
+func (c content) empty() bool {
+	return emptyMessage(c.msg) == (len(c.data) == 0)
+}
+
+// payload returns the content of raw, which is the text of a JSON string or
+// raw itself for other JSON values.
+func payload(raw json.RawMessage) []byte {
+	var s string
+	if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return []byte(s)
+	}
+	return raw
+}
+
+// textMessage returns raw as a JSON string for ProtocolVersion1 clients.
+// Strings are kept, other values are encoded into a string.
+func textMessage(raw json.RawMessage) json.RawMessage {
+	if len(raw) > 0 && raw[0] == '"' {
+		return raw
+	}
+	return jsonString(string(raw))
+}
+
+// jsonString encodes s as a JSON string.
+func jsonString(s string) json.RawMessage {
+	raw, _ := json.Marshal(s)
+	return raw
+}
+
+// emptyMessage reports whether raw is missing, null or an empty string.
+func emptyMessage(raw json.RawMessage) bool {
+	switch string(bytes.TrimSpace(raw)) {
+	case "", "null", `""`:
+		return true
+	}
+	return false
 }
 
+// CommConn holds the connections of a user and the commands pushed to them.
 type CommConn struct {
-	conn    *Conn
+	// conns are ordered by the time they are bound, the newest is the last.
+	conns   []*Conn
 	commMap map[string]*CommObject
 }
 
 type CommManager struct {
 	mu              sync.RWMutex
 	userConnCommMap map[string]*CommConn
+
+	// eventConnMap stores connections subscribed to each event.
+	eventConnMap map[string]map[*Conn]struct{}
+
+	// maxConns limits connections of each user, 0 means no limit.
+	maxConns int
+
+	// registry records the connections bound on this node, which is node,
+	// with leases of leaseTTL. maxConns is enforced by it across nodes
+	// sharing the store.
+	registry PresenceStore
+	node     string
+	leaseTTL time.Duration
 }
 
 func (m *CommManager) Bind(userID string, conn *Conn) error {
@@ -56,25 +282,52 @@ func (m *CommManager) Bind(userID string, conn *Conn) error {
 		return errors.New("conn can't be nil")
 	}
 
+	m.mu.RLock()
+	registered := conn.userId != nil
+	m.mu.RUnlock()
+	if registered {
+		return errors.New("conn already registered")
+	}
+
+	// the store may be remote, so it's not called with m.mu held
+	if err := m.registry.Register(userID, m.node, conn.GetID(), m.maxConns, m.leaseTTL); err != nil {
+		return err
+	}
+
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	err := m.bind(userID, conn)
+	m.mu.Unlock()
+
+	if err != nil {
+		m.registry.Unregister(userID, m.node, conn.GetID())
+	}
+	return err
+}
 
-	if _, ok := m.userConnCommMap[userID]; ok {
-		return errors.New("already registered")
+// bind must be called with m.mu held.
+func (m *CommManager) bind(userID string, conn *Conn) error {
+	if conn.userId != nil {
+		return errors.New("conn already registered")
 	}
-	cc := CommConn{
-		conn:    conn,
-		commMap: make(map[string]*CommObject),
+
+	cc, ok := m.userConnCommMap[userID]
+	if !ok {
+		cc = &CommConn{
+			commMap: make(map[string]*CommObject),
+		}
+		m.userConnCommMap[userID] = cc
+	} else if m.maxConns > 0 && len(cc.conns) >= m.maxConns {
+		return ErrAlreadyRegistered
 	}
+	cc.conns = append(cc.conns, conn)
 
 	var user = userID
 	conn.userId = &user
-	m.userConnCommMap[userID] = &cc
 
 	return nil
 }
 
-// remove all the commands
+// remove the connection, and stop waiting for its response
 // leave others to close the connection
 
 // need a way to unbind without user ID
@@ -86,30 +339,250 @@ func (m *CommManager) Unbind(conn *Conn) error {
 		return errors.New("conn can't be nil")
 	}
 
-	var userID *string
-	userID = conn.userId
+	return m.unbindWith(conn, ErrConnClosed)
+}
+
+// unbindWith is like Unbind, but commands waiting for the response of conn
+// fail with err.
+func (m *CommManager) unbindWith(conn *Conn, err error) error {
 
 	// the connection is not registered yet.
 	if conn.userId == nil {
 		return nil
 	}
 
+	m.mu.Lock()
+	err = m.unbind(conn, err)
+	m.mu.Unlock()
+
+	if err == nil {
+		m.forget(conn)
+	}
+	return err
+}
+
+// unbind removes conn from its user, and commands waiting for its response
+// are detached with err. The user is removed with its last connection. It
+// must be called with m.mu held.
+func (m *CommManager) unbind(conn *Conn, err error) error {
+	cc, ok := m.userConnCommMap[*conn.userId]
+	if !ok {
+		return errors.New("not found")
+	}
+
+	found := false
+	for i, c := range cc.conns {
+		if c == conn {
+			cc.conns = append(cc.conns[:i:i], cc.conns[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("cannot unbind it. it is not yours")
+	}
+
+	for _, obj := range cc.commMap {
+		obj.detach(conn, err)
+	}
+	for event := range conn.events {
+		m.removeSubscription(conn, event)
+	}
+	if len(cc.conns) == 0 {
+		delete(m.userConnCommMap, *conn.userId)
+	}
+
+	return nil
+}
+
+// forget removes the lease of conn unbound from this node.
+func (m *CommManager) forget(conn *Conn) {
+	if err := m.registry.Unregister(*conn.userId, m.node, conn.GetID()); err != nil {
+		log.Println("unregister presence:", err)
+	}
+}
+
+// renew extends the lease of conn if it's still bound. It's called when the
+// peer answers the heartbeat.
+func (m *CommManager) renew(conn *Conn) {
+	m.mu.RLock()
+	bound := conn.userId != nil && m.bound(conn)
+	m.mu.RUnlock()
+	if !bound {
+		return
+	}
+
+	if err := m.registry.Renew(*conn.userId, m.node, conn.GetID(), m.leaseTTL); err != nil {
+		log.Println("renew presence:", err)
+	}
+}
+
+// conns returns the connections bound to userID.
+func (m *CommManager) conns(userID string) []*Conn {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cc, ok := m.userConnCommMap[userID]
+	if !ok {
+		return nil
+	}
+	return append([]*Conn(nil), cc.conns...)
+}
+
+// registered reports whether conn is registered for a user.
+func (m *CommManager) registered(conn *Conn) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return conn.userId != nil
+}
+
+// bound reports whether conn is bound to its user. It must be called with
+// m.mu held.
+func (m *CommManager) bound(conn *Conn) bool {
+	cc, ok := m.userConnCommMap[*conn.userId]
+	if !ok {
+		return false
+	}
+	for _, c := range cc.conns {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// dropUser unbinds the connections of userID and returns them, commands
+// waiting for their response fail with ErrConnDropped. The event is ignored
+// if empty, otherwise only connections subscribed to the event are dropped.
+func (m *CommManager) dropUser(userID, event string) ([]*Conn, error) {
+
+	if userID == "" {
+		return nil, errors.New("userID can't be empty")
+	}
+
+	m.mu.Lock()
+	cc, ok := m.userConnCommMap[userID]
+	if !ok {
+		m.mu.Unlock()
+		return nil, nil
+	}
+
+	var dropped []*Conn
+	for _, conn := range append([]*Conn(nil), cc.conns...) {
+		if !conn.subscribed(event) {
+			continue
+		}
+		m.unbind(conn, ErrConnDropped)
+		dropped = append(dropped, conn)
+	}
+	m.mu.Unlock()
+
+	for _, conn := range dropped {
+		m.forget(conn)
+	}
+	return dropped, nil
+}
+
+// Subscribe subscribes the registered conn to events.
+func (m *CommManager) Subscribe(conn *Conn, events ...string) error {
+
+	if conn == nil {
+		return errors.New("conn can't be nil")
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if cc, ok := m.userConnCommMap[*userID]; ok {
-		if cc.conn == conn {
-			delete(m.userConnCommMap, *userID)
-		} else {
-			return errors.New("cannot unbind it. it is not yours")
+	if conn.userId == nil {
+		return errors.New("this connection is not registered yet")
+	}
+
+	for _, event := range events {
+		if event == "" {
+			continue
 		}
-	} else {
-		return errors.New("not found")
+		if conn.events == nil {
+			conn.events = make(map[string]struct{})
+		}
+		conn.events[event] = struct{}{}
+
+		conns, ok := m.eventConnMap[event]
+		if !ok {
+			conns = make(map[*Conn]struct{})
+			m.eventConnMap[event] = conns
+		}
+		conns[conn] = struct{}{}
+	}
+
+	return nil
+}
+
+// Unsubscribe unsubscribes conn from events.
+func (m *CommManager) Unsubscribe(conn *Conn, events ...string) error {
+
+	if conn == nil {
+		return errors.New("conn can't be nil")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, event := range events {
+		m.removeSubscription(conn, event)
 	}
 
 	return nil
 }
 
+// removeSubscription must be called with m.mu held.
+func (m *CommManager) removeSubscription(conn *Conn, event string) {
+	delete(conn.events, event)
+
+	if conns, ok := m.eventConnMap[event]; ok {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(m.eventConnMap, event)
+		}
+	}
+}
+
+// subscribers returns users having connections subscribed to event.
+func (m *CommManager) subscribers(event string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]struct{})
+	var users []string
+	for conn := range m.eventConnMap[event] {
+		if _, ok := seen[*conn.userId]; ok {
+			continue
+		}
+		seen[*conn.userId] = struct{}{}
+		users = append(users, *conn.userId)
+	}
+
+	return users
+}
+
+// users returns all bound users, or only subscribers of event if it's not
+// empty.
+func (m *CommManager) users(event string) []string {
+	if event != "" {
+		return m.subscribers(event)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]string, 0, len(m.userConnCommMap))
+	for userID := range m.userConnCommMap {
+		users = append(users, userID)
+	}
+
+	return users
+}
+
 func (m *CommManager) hasUser(userId string) (bool, error) {
 
 	if userId == "" {
@@ -125,7 +598,9 @@ func (m *CommManager) hasUser(userId string) (bool, error) {
 	return false, nil
 }
 
-func (m *CommManager) newCommand(userID, commID string) (*CommObject, error) {
+// newCommand creates a command sent to connections of userID chosen by mode.
+// If event is not empty, only connections subscribed to it are chosen.
+func (m *CommManager) newCommand(userID, commID, mode, event string) (*CommObject, error) {
 
 	if userID == "" {
 		return nil, errors.New("userID can't be empty")
@@ -139,13 +614,27 @@ func (m *CommManager) newCommand(userID, commID string) (*CommObject, error) {
 	defer m.mu.Unlock()
 
 	if cc, ok := m.userConnCommMap[userID]; !ok {
-		return nil, errors.New("no such user")
+		return nil, ErrUserNotConnected
 	} else if _, ok := cc.commMap[commID]; ok {
-		return nil, errors.New("newCommand: already existed")
+		return nil, ErrDuplicateCommand
 	} else {
+		var conns []*Conn
+		for _, conn := range cc.conns {
+			if conn.subscribed(event) {
+				conns = append(conns, conn)
+			}
+		}
+		if len(conns) == 0 {
+			return nil, fmt.Errorf("%w: no connection subscribed to the event", ErrUserNotConnected)
+		}
+
 		comm := CommObject{
-			conn:   cc.conn,
+			mode:   mode,
 			waitCH: make(chan struct{}),
+			conns:  conns,
+		}
+		if mode == PushNewest {
+			comm.conns = conns[len(conns)-1:]
 		}
 
 		cc.commMap[commID] = &comm
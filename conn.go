@@ -1,23 +1,71 @@
 package wserver
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"io"
 	"log"
+	"net"
 	"sync"
+	"time"
 )
 
 const (
-	RegisterMessageType = 1
-	NormalMessageType   = 255
+	RegisterMessageType    = 1
+	SubscribeMessageType   = 2
+	UnsubscribeMessageType = 3
+	RequestMessageType     = 4
+	ReauthMessageType      = 5
+	NormalMessageType      = 255
 )
 
+// closeWriteWait is the time allowed to write a close frame to the peer.
+const closeWriteWait = time.Second
+
+// QueuePolicy decides what Conn.Write does when the send queue is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock waits for room in the queue up to the write wait, then
+	// fails with ErrQueueFull.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest discards the oldest queued message to make room.
+	QueueDropOldest
+	// QueueDisconnect closes the slow connection and fails with ErrQueueFull.
+	QueueDisconnect
+)
+
+// ErrPongTimeout describes error when the peer doesn't answer ping or send
+// anything in time.
+var ErrPongTimeout = errors.New("pong wait exceeded")
+
+// ErrPingFailed describes error when ping can't be written to the peer.
+var ErrPingFailed = errors.New("write ping failed")
+
+// ErrQueueFull describes error when a message can't be queued because the
+// peer doesn't read fast enough.
+var ErrQueueFull = errors.New("send queue is full")
+
+// Protocol versions of the client, given in RegisterMessage.
+const (
+	// ProtocolVersion1 sends messages of commands as JSON strings, so JSON
+	// content is encoded twice. It's the default.
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 sends messages of commands as they are given, JSON
+	// values included.
+	ProtocolVersion2 = 2
+)
+
+// WSMessage is the message sent by the client. Body is either a JSON value,
+// or a string containing it as ProtocolVersion1 clients send.
 type WSMessage struct {
-	Kind int    `json:"Kind"`
-	Body string `json:"Body"`
+	Kind int             `json:"Kind"`
+	Body json.RawMessage `json:"Body"`
 }
 
 // Conn wraps websocket.Conn with Conn. It defines to listen and read
@@ -25,36 +73,149 @@ type WSMessage struct {
 type Conn struct {
 	Conn *websocket.Conn
 
+	// AfterReadFunc is called with each message read from the client,
+	// before it's handled. BeforeCloseFunc is called once before the
+	// connection is closed.
 	AfterReadFunc   func(messageType int, r io.Reader)
 	BeforeCloseFunc func()
 
-	once   sync.Once
-	id     string
-	stopCh chan struct{}
+	once      sync.Once
+	id        string
+	stopCh    chan struct{}
+	closeOnce sync.Once
+
+	// closeCode and closeReason tell why the connection is closed, the
+	// first one recorded is kept. They're guarded by closeMu.
+	closeMu     sync.Mutex
+	closeCode   int
+	closeReason string
+
+	// when the connection is established
+	connectedAt time.Time
 
 	// if a socket is bound, then the string userId must not be empty
 	userId *string
 
+	// the events subscribed, guarded by the lock of CommManager
+	events map[string]struct{}
+
+	// version is the protocol version given in the register message, it's
+	// set before the connection is bound
+	version int
+
+	// codec is negotiated by the websocket subprotocol
+	codec Codec
+
+	// requests holds a slot for each request being served
+	requests chan struct{}
+
+	// claims are given by Server.AuthRequest or Server.VerifyToken. When
+	// the token expires, expiring tells the client and expiry closes the
+	// connection. They're guarded by authMu.
+	authMu   sync.Mutex
+	claims   map[string]interface{}
+	expiring *time.Timer
+	expiry   *time.Timer
+	expiryAt time.Time
+
+	// authenticated is true if Server.AuthRequest registered the connection
+	authenticated bool
+
+	// ctx is cancelled when the connection is closed, requests of the
+	// client are handled with it
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	// if the socket registered or not
 	registered bool
 
+	// sendCh queues outbound messages, they are written by writeLoop only
+	// since websocket.Conn supports one concurrent writer
+	sendCh chan []byte
+
 	// the websocket handler
 	// must not be empty
 	wh *websocketHandler
 }
 
-// Write write p to the websocket connection. The error returned will always
-// be nil if success.
+// Write queues p to be written to the websocket connection, it's safe for
+// concurrent use. The error returned will always be nil if success. When the
+// queue is full, it behaves as the QueuePolicy of the server.
 func (c *Conn) Write(p []byte) (n int, err error) {
 	select {
 	case <-c.stopCh:
-		return 0, errors.New("Conn is closed, can't be written")
+		return 0, ErrConnClosed
+	case c.sendCh <- p:
+		return len(p), nil
 	default:
-		err = c.Conn.WriteMessage(websocket.TextMessage, p)
-		if err != nil {
-			return 0, err
+	}
+
+	switch c.wh.queuePolicy {
+	case QueueDropOldest:
+		for {
+			select {
+			case <-c.stopCh:
+				return 0, ErrConnClosed
+			case c.sendCh <- p:
+				return len(p), nil
+			default:
+			}
+			// discard the oldest one, another writer may have taken the
+			// room so try again
+			select {
+			case <-c.sendCh:
+			default:
+			}
+		}
+	case QueueDisconnect:
+		c.CloseWithReason(websocket.CloseTryAgainLater, "slow consumer")
+		return 0, ErrQueueFull
+	default:
+		timer := time.NewTimer(c.wh.writeWait)
+		defer timer.Stop()
+
+		select {
+		case <-c.stopCh:
+			return 0, ErrConnClosed
+		case c.sendCh <- p:
+			return len(p), nil
+		case <-timer.C:
+			return 0, ErrQueueFull
+		}
+	}
+}
+
+// writeLoop writes queued messages and pings to the websocket connection
+// until it's closed. The connection is closed if a write fails or exceeds
+// write wait.
+func (c *Conn) writeLoop() {
+	ticker := time.NewTicker(c.wh.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(c.wh.writeWait)
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.wh.deadPeer(c, ErrPingFailed)
+				return
+			}
+		case p := <-c.sendCh:
+			if p == nil {
+				// queued by closeAfterWrite
+				c.CloseWithReason(c.closeStatus())
+				return
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(c.wh.writeWait))
+			if err := c.Conn.WriteMessage(c.codec.MessageType(), p); err != nil {
+				log.Println(err.Error())
+				c.setCloseStatus(websocket.CloseAbnormalClosure, err.Error())
+				c.Close()
+				return
+			}
 		}
-		return len(p), nil
 	}
 }
 
@@ -68,48 +229,161 @@ func (c *Conn) GetID() string {
 	return c.id
 }
 
+// OnMessage handles a message of the client. Text messages are JSON, binary
+// ones are decoded by the codec of the connection.
 func (c *Conn) OnMessage(messageType int, r io.Reader) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	if c.wh.onMessage != nil {
+		c.wh.onMessage(c, messageType, data)
+	}
+	if c.AfterReadFunc != nil {
+		c.AfterReadFunc(messageType, bytes.NewReader(data))
+	}
+
+	var codec Codec = JSONCodec{}
+	if messageType == websocket.BinaryMessage {
+		codec = c.codec
+	}
 	var wm WSMessage
-	decoder := json.NewDecoder(r)
-	if err := decoder.Decode(&wm); err != nil {
+	if err := codec.Unmarshal(data, &wm); err != nil {
 		return
 	}
 
 	if wm.Kind == RegisterMessageType {
-		// TODO close socket in this case
-		// should exit goroutine
-		c.HandleRegister(wm.Body)
+		c.HandleRegister(string(payload(wm.Body)))
+		return
+	} else if wm.Kind == SubscribeMessageType || wm.Kind == UnsubscribeMessageType {
+		c.HandleSubscribe(wm.Kind, string(payload(wm.Body)))
 		return
 	} else if wm.Kind == NormalMessageType {
-		c.HandleCommand(wm.Body)
+		if err := c.HandleCommand(string(payload(wm.Body))); err == ErrNotRegistered {
+			c.closeAfterWrite(websocket.ClosePolicyViolation, CodeNotRegistered)
+		}
+		return
+	} else if wm.Kind == RequestMessageType {
+		c.HandleRequest(string(payload(wm.Body)))
+		return
+	} else if wm.Kind == ReauthMessageType {
+		c.HandleReauth(string(payload(wm.Body)))
 		return
 	}
 
 }
 
+// HandleRegister binds the connection to the user of the register message,
+// then reports the result to Server.OnRegister and ProtocolVersion2 clients.
+// A connection failing to register is closed with
+// websocket.ClosePolicyViolation.
 func (c *Conn) HandleRegister(body string) error {
+	userID, claims, err := c.register(body)
+
+	if c.version >= ProtocolVersion2 {
+		result := &RegisterResult{UserID: userID, Status: CommStatusOK}
+		if err != nil {
+			result = &RegisterResult{Status: CommStatusError, Code: errorCode(err), Error: err.Error()}
+		}
+		if p, err := c.codec.Marshal(&CommRequest{Register: result}); err == nil {
+			c.Write(p)
+		}
+	}
+
+	// the token expires after the client is told the result
+	if claims != nil {
+		c.setClaims(claims)
+	}
+
+	if c.wh.onRegister != nil {
+		c.wh.onRegister(c, userID, err)
+	}
+
+	// registered before, it's still usable
+	if err != nil && !c.wh.cm.registered(c) {
+		c.closeAfterWrite(websocket.ClosePolicyViolation, errorCode(err))
+	}
+	return err
+}
+
+// register binds the connection and returns the user, which is empty if the
+// token is rejected, and the claims of the token if it's bound.
+func (c *Conn) register(body string) (string, map[string]interface{}, error) {
 
 	rm := RegisterMessage{}
 	err := json.Unmarshal([]byte(body), &rm)
 
 	if err != nil {
-		return err
+		return "", nil, fmt.Errorf("%w: %v", ErrRequestIllegal, err)
+	}
+
+	// registered by the upgrade request, the token is ignored
+	if c.authenticated {
+		return *c.userId, nil, c.wh.cm.Subscribe(c, rm.Event)
+	}
+
+	if c.userId == nil {
+		c.version = ProtocolVersion1
+		if rm.Version > ProtocolVersion1 {
+			c.version = ProtocolVersion2
+		}
 	}
 
 	wh := c.wh
 
 	userID := rm.Token
-	if wh.calcUserIDFunc != nil {
+	var claims map[string]interface{}
+	if wh.verifyToken != nil {
+		uID, cl, err := wh.verifyToken(rm.Token)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrTokenExpired) {
+				err = fmt.Errorf("%w: %v", ErrInvalidToken, err)
+			}
+			return "", nil, err
+		}
+		userID, claims = uID, cl
+	} else if wh.calcUserIDFunc != nil {
 		uID, ok := wh.calcUserIDFunc(rm.Token)
 		if !ok {
-			return errors.New("calcUserIDFunc failed")
+			return "", nil, ErrInvalidToken
 		}
 		userID = uID
 	}
 
 	// bind
-	return wh.cm.Bind(userID, c)
+	if err := wh.cm.Bind(userID, c); err != nil {
+		return userID, nil, err
+	}
+
+	// the event in register message is the first subscription
+	return userID, claims, wh.cm.Subscribe(c, rm.Event)
+}
+
+// HandleSubscribe subscribes or unsubscribes the connection to events
+// according to kind.
+func (c *Conn) HandleSubscribe(kind int, body string) error {
+
+	sm := SubscribeMessage{}
+	if err := json.Unmarshal([]byte(body), &sm); err != nil {
+		return err
+	}
 
+	if kind == UnsubscribeMessageType {
+		return c.wh.cm.Unsubscribe(c, sm.Events...)
+	}
+	return c.wh.cm.Subscribe(c, sm.Events...)
+}
+
+// subscribed reports whether the connection subscribed to event. Empty event
+// matches any connection. It must be called with the lock of CommManager
+// held.
+func (c *Conn) subscribed(event string) bool {
+	if event == "" {
+		return true
+	}
+	_, ok := c.events[event]
+	return ok
 }
 
 func (c *Conn) HandleCommand(body string) error {
@@ -127,7 +401,7 @@ func (c *Conn) HandleCommand(body string) error {
 
 	userID := c.userId
 	if userID == nil {
-		return errors.New("this connection is not registered yet")
+		return ErrNotRegistered
 	}
 
 	obj, _ := wh.cm.lookupCommand(*userID, commandID)
@@ -135,16 +409,69 @@ func (c *Conn) HandleCommand(body string) error {
 	if obj == nil {
 		return errors.New("cannot find this command")
 	}
+	cr.legacy = c.version < ProtocolVersion2
+
+	return obj.respond(c, &cr)
+}
+
+// HandleRequest calls the handler of the request in background, then writes
+// the reply. The connection must be registered.
+func (c *Conn) HandleRequest(body string) error {
+
+	req := Request{}
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		return err
+	}
+	req.Conn = c
+
+	if c.userId == nil {
+		return c.reply(errorReply(req.Id, ErrNotRegistered))
+	}
+	req.UserID = *c.userId
+
+	// bounded, the client must wait for replies before sending more
+	select {
+	case c.requests <- struct{}{}:
+	default:
+		return c.reply(errorReply(req.Id, ErrTooManyRequests))
+	}
 
-	obj.response = &cr
-	close(obj.waitCH)
+	go func() {
+		defer func() { <-c.requests }()
 
+		if err := c.reply(c.wh.router.serve(c.ctx, &req)); err != nil {
+			log.Println("write reply:", err)
+		}
+	}()
 	return nil
 }
 
+// reply writes r to the client.
+func (c *Conn) reply(r *Reply) error {
+	p, err := c.codec.Marshal(&CommRequest{Reply: r})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(p)
+	return err
+}
+
 // Listen listens for receive data from websocket connection. It blocks
 // until websocket connection is closed.
 func (c *Conn) Listen() {
+	go c.writeLoop()
+
+	if c.wh.maxMessageSize > 0 {
+		c.Conn.SetReadLimit(c.wh.maxMessageSize)
+	}
+
+	// the peer is alive as long as it answers ping or sends anything
+	c.Conn.SetReadDeadline(time.Now().Add(c.wh.pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		err := c.Conn.SetReadDeadline(time.Now().Add(c.wh.pongWait))
+		c.wh.cm.renew(c)
+		return err
+	})
 
 ReadLoop:
 	for {
@@ -154,10 +481,22 @@ ReadLoop:
 		default:
 			messageType, r, err := c.Conn.NextReader()
 			if err != nil {
-				// TODO: handle read error maybe
+				var ne net.Error
+				var ce *websocket.CloseError
+				if errors.As(err, &ne) && ne.Timeout() {
+					c.wh.deadPeer(c, ErrPongTimeout)
+				} else if errors.As(err, &ce) {
+					c.setCloseStatus(ce.Code, ce.Text)
+				} else if err == websocket.ErrReadLimit {
+					// closed by websocket with CloseMessageTooBig
+					c.setCloseStatus(websocket.CloseMessageTooBig, err.Error())
+				} else {
+					c.setCloseStatus(websocket.CloseAbnormalClosure, err.Error())
+				}
 				log.Println(err.Error())
 				break ReadLoop
 			}
+			c.Conn.SetReadDeadline(time.Now().Add(c.wh.pongWait))
 			// TODO handle error
 			c.OnMessage(messageType, r)
 
@@ -167,21 +506,85 @@ ReadLoop:
 
 // Close close the connection.
 func (c *Conn) Close() error {
+	err := errors.New("Conn already been closed")
+	c.closeOnce.Do(func() {
+		if c.BeforeCloseFunc != nil {
+			c.BeforeCloseFunc()
+		}
+		c.stopExpiry()
+		c.Conn.Close()
+		close(c.stopCh)
+		c.cancel()
+		err = nil
+	})
+	return err
+}
+
+// CloseWithReason sends a close frame with code and reason to the peer, then
+// close the connection. The code is one of the websocket.Close* constants.
+func (c *Conn) CloseWithReason(code int, reason string) error {
 	select {
 	case <-c.stopCh:
 		return errors.New("Conn already been closed")
 	default:
-		c.Conn.Close()
-		close(c.stopCh)
-		return nil
 	}
+
+	c.setCloseStatus(code, reason)
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteWait))
+	return c.Close()
+}
+
+// closeAfterWrite closes the connection with code and reason once the
+// messages queued are written, or after the write wait at the latest.
+func (c *Conn) closeAfterWrite(code int, reason string) {
+	c.setCloseStatus(code, reason)
+	if _, err := c.Write(nil); err != nil {
+		c.CloseWithReason(code, reason)
+		return
+	}
+	time.AfterFunc(c.wh.writeWait, func() {
+		c.CloseWithReason(code, reason)
+	})
+}
+
+// setCloseStatus records why the connection is closed, unless it's recorded
+// already.
+func (c *Conn) setCloseStatus(code int, reason string) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closeCode == 0 {
+		c.closeCode = code
+		c.closeReason = reason
+	}
+}
+
+// closeStatus returns the close code and reason recorded, or
+// websocket.CloseAbnormalClosure if none is.
+func (c *Conn) closeStatus() (int, string) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closeCode == 0 {
+		return websocket.CloseAbnormalClosure, ""
+	}
+	return c.closeCode, c.closeReason
 }
 
 // NewConn wraps conn.
 func NewConn(conn *websocket.Conn, wh *websocketHandler) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Conn{
 		wh:     wh,
 		Conn:   conn,
 		stopCh: make(chan struct{}),
+		sendCh: make(chan []byte, wh.sendQueueSize),
+		codec:  JSONCodec{},
+		ctx:    ctx,
+		cancel: cancel,
+
+		requests:    make(chan struct{}, wh.maxRequests),
+		connectedAt: time.Now(),
 	}
 }
@@ -0,0 +1,206 @@
+package wserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrUserNotConnected describes error when the user has no connection to
+// receive the command.
+var ErrUserNotConnected = errors.New("user not connected")
+
+// ErrDuplicateCommand describes error when the command ID is still used by
+// another command of the user.
+var ErrDuplicateCommand = errors.New("duplicate command id")
+
+// ErrTimeout describes error when the client doesn't respond the command in
+// time.
+var ErrTimeout = errors.New("timeout waiting command response")
+
+// ErrUnauthorized describes error when the request is rejected by
+// Server.PushAuth.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrForbidden describes error when the authenticated client is not allowed
+// to connect, or the push is denied by Server.PushPolicy.
+var ErrForbidden = errors.New("forbidden")
+
+// ErrMethodNotAllowed describes error when the HTTP method is not accepted by
+// the endpoint.
+var ErrMethodNotAllowed = errors.New("method not allowed")
+
+// ErrNoSuchCommand describes error when the status of an unknown or expired
+// asynchronous command is requested.
+var ErrNoSuchCommand = errors.New("no such command")
+
+// ErrInvalidToken describes error when the token of the register message is
+// rejected by Server.AuthToken.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrTokenExpired describes error when the token of the client is expired.
+var ErrTokenExpired = errors.New("token expired")
+
+// ErrNotRegistered describes error when a connection responds commands or
+// sends requests before it's registered.
+var ErrNotRegistered = errors.New("connection not registered")
+
+// ErrRegisterTimeout describes error when a connection doesn't register in
+// Server.RegisterTimeout.
+var ErrRegisterTimeout = errors.New("register timeout")
+
+// ErrTooManyRequests describes error when a connection sends more requests
+// than Server.MaxRequests at once, or the caller of push requests exceeds the
+// rate allowed by Server.PushLimit.
+var ErrTooManyRequests = errors.New("too many requests")
+
+// ErrClient describes error reported by the client executing the command.
+var ErrClient = errors.New("client error")
+
+// ClientError is the failure reported by the client in CommResponse, with
+// the code and message given by the client. It matches ErrClient.
+type ClientError struct {
+	Code    string
+	Message string
+}
+
+func (e *ClientError) Error() string {
+	s := ErrClient.Error()
+	if e.Code != "" {
+		s += ": " + e.Code
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// Unwrap returns ErrClient.
+func (e *ClientError) Unwrap() error {
+	return ErrClient
+}
+
+// Error codes identify the errors in ErrorResponse.
+const (
+	CodeRequestIllegal    = "request_illegal"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeMethodNotAllowed  = "method_not_allowed"
+	CodeUserNotConnected  = "user_not_connected"
+	CodeNoSuchCommand     = "no_such_command"
+	CodeDuplicateCommand  = "duplicate_command"
+	CodeTimeout           = "timeout"
+	CodeConnClosed        = "conn_closed"
+	CodeConnDropped       = "conn_dropped"
+	CodeQueueFull         = "queue_full"
+	CodeShuttingDown      = "shutting_down"
+	CodeClientError       = "client_error"
+	CodeNoSuchMethod      = "no_such_method"
+	CodeInvalidToken      = "invalid_token"
+	CodeAlreadyRegistered = "already_registered"
+	CodeNotRegistered     = "not_registered"
+	CodeRegisterTimeout   = "register_timeout"
+	CodeTokenExpired      = "token_expired"
+	CodeTooManyRequests   = "too_many_requests"
+	CodeInternal          = "internal"
+)
+
+// ErrorResponse is the JSON body of a failed request. Retryable tells whether
+// the same request may succeed later, like after the user reconnects. For a
+// ClientError, ClientCode and Message are the ones reported by the client.
+type ErrorResponse struct {
+	Code       string `json:"code"`
+	ClientCode string `json:"clientCode,omitempty"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+}
+
+// knownErrors maps errors to their HTTP status and code.
+var knownErrors = []struct {
+	err       error
+	status    int
+	code      string
+	retryable bool
+}{
+	{ErrRequestIllegal, http.StatusBadRequest, CodeRequestIllegal, false},
+	{ErrUnauthorized, http.StatusUnauthorized, CodeUnauthorized, false},
+	{ErrForbidden, http.StatusForbidden, CodeForbidden, false},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, CodeMethodNotAllowed, false},
+	{ErrUserNotConnected, http.StatusNotFound, CodeUserNotConnected, true},
+	{ErrNoSuchCommand, http.StatusNotFound, CodeNoSuchCommand, false},
+	{ErrDuplicateCommand, http.StatusConflict, CodeDuplicateCommand, false},
+	{ErrTimeout, http.StatusGatewayTimeout, CodeTimeout, true},
+	{ErrConnClosed, http.StatusServiceUnavailable, CodeConnClosed, true},
+	{ErrConnDropped, http.StatusServiceUnavailable, CodeConnDropped, true},
+	{ErrQueueFull, http.StatusServiceUnavailable, CodeQueueFull, true},
+	{ErrShuttingDown, http.StatusServiceUnavailable, CodeShuttingDown, true},
+	{ErrClient, http.StatusBadGateway, CodeClientError, false},
+	{ErrNoSuchMethod, http.StatusNotFound, CodeNoSuchMethod, false},
+	{ErrInvalidToken, http.StatusUnauthorized, CodeInvalidToken, false},
+	{ErrAlreadyRegistered, http.StatusConflict, CodeAlreadyRegistered, false},
+	{ErrNotRegistered, http.StatusForbidden, CodeNotRegistered, false},
+	{ErrRegisterTimeout, http.StatusRequestTimeout, CodeRegisterTimeout, false},
+	{ErrTokenExpired, http.StatusUnauthorized, CodeTokenExpired, false},
+	{ErrTooManyRequests, http.StatusTooManyRequests, CodeTooManyRequests, true},
+}
+
+// errorResponse returns the HTTP status and ErrorResponse of err. Unknown
+// errors are internal ones with status 500.
+func errorResponse(err error) (int, *ErrorResponse) {
+	var ce *ClientError
+	if errors.As(err, &ce) {
+		return http.StatusBadGateway, &ErrorResponse{
+			Code:       CodeClientError,
+			ClientCode: ce.Code,
+			Message:    ce.Message,
+		}
+	}
+
+	for _, k := range knownErrors {
+		if errors.Is(err, k.err) {
+			return k.status, &ErrorResponse{
+				Code:      k.code,
+				Message:   err.Error(),
+				Retryable: k.retryable,
+			}
+		}
+	}
+	return http.StatusInternalServerError, &ErrorResponse{
+		Code:    CodeInternal,
+		Message: err.Error(),
+	}
+}
+
+// errorCode returns the code of err.
+func errorCode(err error) string {
+	_, resp := errorResponse(err)
+	return resp.Code
+}
+
+// codeError is the reverse of errorCode, it rebuilds the error with message
+// reported by another node, so it still matches the known error by errors.Is.
+func codeError(code, message string) error {
+	for _, k := range knownErrors {
+		if k.code != code {
+			continue
+		}
+		if message == k.err.Error() {
+			return k.err
+		}
+		if strings.HasPrefix(message, k.err.Error()) {
+			return fmt.Errorf("%w%s", k.err, strings.TrimPrefix(message, k.err.Error()))
+		}
+		return fmt.Errorf("%w: %s", k.err, message)
+	}
+	return errors.New(message)
+}
+
+// writeError responds err as JSON with its status.
+func writeError(w http.ResponseWriter, err error) {
+	status, resp := errorResponse(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
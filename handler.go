@@ -1,11 +1,17 @@
 package wserver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,198 +25,754 @@ type websocketHandler struct {
 	// cm stores relations about websocket connection and userID.
 	cm *CommManager
 
+	// codecs are the ones clients may negotiate, the first is the default.
+	codecs []Codec
+
+	// router handles requests of clients.
+	router *router
+
 	// calcUserIDFunc defines to calculate userID by token. The userID will
 	// be equal to token if this function is nil.
 	calcUserIDFunc func(token string) (userID string, ok bool)
+
+	// sendQueueSize, writeWait and queuePolicy configure the outbound
+	// queue of each connection.
+	sendQueueSize int
+	writeWait     time.Duration
+	queuePolicy   QueuePolicy
+
+	// maxRequests is the number of requests of a connection handled at once.
+	maxRequests int
+
+	// maxMessageSize is the size of messages read at most, not limited if
+	// zero.
+	maxMessageSize int64
+
+	// pingInterval and pongWait configure the heartbeat, onDeadPeer is
+	// called when a peer misses it.
+	pingInterval time.Duration
+	pongWait     time.Duration
+	onDeadPeer   func(conn *Conn, reason error)
+
+	// hooks of the connection lifecycle, see Server.
+	onConnect  func(conn *Conn, r *http.Request)
+	onRegister func(conn *Conn, userID string, err error)
+	onMessage  func(conn *Conn, messageType int, data []byte)
+	onClose    func(conn *Conn, code int, reason string)
+
+	// registerTimeout is the time allowed to a connection to register.
+	registerTimeout time.Duration
+
+	// reauthNotice is the time before the token of a connection expires
+	// when the client is told to reauthenticate.
+	reauthNotice time.Duration
+
+	// verifyToken checks the token of the register message instead of
+	// calcUserIDFunc if it's not nil.
+	verifyToken func(token string) (userID string, claims map[string]interface{}, err error)
+
+	// authRequest authenticates the upgrade request, nil if clients
+	// authenticate by the register message only.
+	authRequest func(r *http.Request) (userID string, claims map[string]interface{}, err error)
+
+	// mu guards conns and closing. conns are all the connections being
+	// listened, registered or not, and wg waits for them.
+	mu      sync.Mutex
+	conns   map[*Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
 }
 
 // RegisterMessage defines message struct client send after connect
 // to the server.
+//
+// Version is the protocol version of the client, ProtocolVersion1 if it's
+// zero.
 type RegisterMessage struct {
-	Token string `json:"token"`
-	Event string `json:"event"`
+	Token   string `json:"token"`
+	Event   string `json:"event"`
+	Version int    `json:"version,omitempty"`
 }
 
-type lookupHandler struct {
-	cm *CommManager
+// RegisterResult answers the register message of ProtocolVersion2 clients,
+// it's sent in Register of a CommRequest. Status is CommStatusOK with the
+// UserID bound, or CommStatusError with Code and Error.
+type RegisterResult struct {
+	UserID string `json:"userId,omitempty"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
-// if the channel is established in this server.
-// if not, return 404 respond
-// otherwise, 200 OK
-func (lh *lookupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+// First try to upgrade connection to websocket. If success, connection will
+// be kept until client send close message or server drop them.
+func (wh *websocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wh.mu.Lock()
+	if wh.closing {
+		wh.mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	wh.wg.Add(1)
+	wh.mu.Unlock()
+	defer wh.wg.Done()
+
+	// authenticate before upgrade
+	var userID string
+	var claims map[string]interface{}
+	if wh.authRequest != nil {
+		var err error
+		if userID, claims, err = wh.authRequest(r); err != nil {
+			if !errors.Is(err, ErrForbidden) && !errors.Is(err, ErrUnauthorized) {
+				err = fmt.Errorf("%w: %v", ErrUnauthorized, err)
+			}
+			writeError(w, err)
+			return
+		}
+	}
+
+	wsConn, err := wh.upgrader.Upgrade(w, r, nil)
+	if err != nil {
 		return
 	}
 
-	vars := r.URL.Query()
-	userID := vars.Get("userid")
+	// handle Websocket request
+	conn := NewConn(wsConn, wh)
+	conn.codec = negotiate(wh.codecs, wsConn.Subprotocol())
+	defer conn.Close()
 
-	if userID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(ErrRequestIllegal.Error()))
+	if !wh.track(conn) {
+		conn.CloseWithReason(websocket.CloseGoingAway, "server shutdown")
 		return
 	}
+	defer wh.untrack(conn)
+
+	if wh.onConnect != nil {
+		wh.onConnect(conn, r)
+	}
+
+	// OnClose follows OnConnect however the connection ends
+	defer func() {
+		conn.Close()
+		wh.cm.Unbind(conn)
 
-	found, _ := lh.cm.hasUser(userID)
+		if wh.onClose != nil {
+			code, reason := conn.closeStatus()
+			wh.onClose(conn, code, reason)
+		}
+	}()
+
+	// the user authenticated by the request needs no register message
+	if userID != "" {
+		conn.authenticated = true
+		conn.version = ProtocolVersion1
+		if v, _ := strconv.Atoi(r.URL.Query().Get("version")); v > ProtocolVersion1 {
+			conn.version = ProtocolVersion2
+		}
+
+		err := wh.cm.Bind(userID, conn)
+		if err == nil {
+			conn.setClaims(claims)
+		}
+		if wh.onRegister != nil {
+			wh.onRegister(conn, userID, err)
+		}
+		if err != nil {
+			conn.CloseWithReason(websocket.ClosePolicyViolation, errorCode(err))
+			return
+		}
+	}
 
-	if found {
-		w.WriteHeader(http.StatusNotFound)
+	// the connection must register in time
+	if wh.registerTimeout > 0 {
+		timer := time.AfterFunc(wh.registerTimeout, func() {
+			if !wh.cm.registered(conn) {
+				conn.CloseWithReason(websocket.ClosePolicyViolation, CodeRegisterTimeout)
+			}
+		})
+		defer timer.Stop()
 	}
 
+	conn.Listen()
 }
 
-// First try to upgrade connection to websocket. If success, connection will
-// be kept until client send close message or server drop them.
-func (wh *websocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	wsConn, err := wh.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
+// track records conn being listened, it returns false if the handler is
+// shutting down.
+func (wh *websocketHandler) track(conn *Conn) bool {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if wh.closing {
+		return false
 	}
-	defer wsConn.Close()
+	wh.conns[conn] = struct{}{}
+	return true
+}
 
-	// handle Websocket request
-	conn := NewConn(wsConn, wh)
+func (wh *websocketHandler) untrack(conn *Conn) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
 
-	conn.BeforeCloseFunc = func() {
-		// unbind
-		wh.cm.Unbind(conn)
+	delete(wh.conns, conn)
+}
+
+// shutdown stops accepting connections, then unbinds and closes the current
+// ones with a going away close frame. Commands waiting for their response
+// fail with ErrShuttingDown.
+func (wh *websocketHandler) shutdown() {
+	wh.mu.Lock()
+	wh.closing = true
+	conns := make([]*Conn, 0, len(wh.conns))
+	for conn := range wh.conns {
+		conns = append(conns, conn)
 	}
+	wh.mu.Unlock()
 
-	conn.Listen()
+	for _, conn := range conns {
+		wh.cm.unbindWith(conn, ErrShuttingDown)
+		conn.CloseWithReason(websocket.CloseGoingAway, "server shutdown")
+	}
+}
+
+// deadPeer closes conn missing the heartbeat and reports reason. It's called
+// at most once for each connection.
+func (wh *websocketHandler) deadPeer(conn *Conn, reason error) {
+	conn.setCloseStatus(websocket.CloseAbnormalClosure, reason.Error())
+	if conn.Close() != nil {
+		// closed by others already
+		return
+	}
 	wh.cm.Unbind(conn)
+
+	if wh.onDeadPeer != nil {
+		wh.onDeadPeer(conn, reason)
+	}
 }
 
 // closeConns unbind conns filtered by userID and event and close them.
 // The userID can't be empty, but event can be empty. The event will be ignored
 // if empty.
 func (wh *websocketHandler) closeConns(userID, event string) (int, error) {
-	return 0, nil
+	conns, err := wh.cm.dropUser(userID, event)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, conn := range conns {
+		conn.CloseWithReason(websocket.ClosePolicyViolation, "dropped by server")
+	}
+	return len(conns), nil
 }
 
 // ErrRequestIllegal describes error when data of the request is unaccepted.
 var ErrRequestIllegal = errors.New("request data illegal")
 
+// ErrConnClosed describes error when a command fails because its connection
+// has been closed before responding.
+var ErrConnClosed = errors.New("connection closed")
+
+// ErrConnDropped describes error when a command fails because its connection
+// has been dropped by the server.
+var ErrConnDropped = errors.New("connection dropped by server")
+
+// ErrShuttingDown describes error when a command fails because the server is
+// shutting down.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// DropMessage defines message struct send by client to drop connections of a
+// user.
+type DropMessage struct {
+	UserID string `json:"userId"`
+	Event  string `json:"event"`
+}
+
+// dropHandler defines to handle drop connection request.
+type dropHandler struct {
+	// authFunc defines to authorize request. The request will proceed only
+	// when it returns true.
+	authFunc func(r *http.Request) bool
+	wh       *websocketHandler
+
+	// authorize checks the user and event dropped by Server.PushPolicy.
+	authorize func(r *http.Request, msg *CommMessage) error
+}
+
+// Authorize if needed. Then close the connections of the user and respond
+// the number of closed connections.
+func (dh *dropHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	// authorize
+	if dh.authFunc != nil {
+		if ok := dh.authFunc(r); !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+	}
+
+	var msg DropMessage
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&msg); err != nil || msg.UserID == "" {
+		writeError(w, ErrRequestIllegal)
+		return
+	}
+
+	if err := dh.authorize(r, &CommMessage{UserID: msg.UserID, Event: msg.Event}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	n, err := dh.wh.closeConns(msg.UserID, msg.Event)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"dropped": n})
+}
+
 // pushHandler defines to handle push message request.
 type pushHandler struct {
 	// authFunc defines to authorize request. The request will proceed only
 	// when it returns true.
 	authFunc func(r *http.Request) bool
 	cm       *CommManager
+
+	// policy authorizes each command after authFunc if it's not nil.
+	policy func(r *http.Request, msg *CommMessage) error
+
+	// limit charges the commands of a request once policy allows all of
+	// them, if it's not nil.
+	limit func(r *http.Request, commands int) error
+
+	// path is the push path, status of asynchronous commands is served
+	// under path + "/{commId}".
+	path string
+
+	// caller identifies the caller of a request, results of asynchronous
+	// commands are only served to the caller pushing them.
+	caller func(r *http.Request) string
+
+	// callbackHosts are the patterns of hosts callbacks are posted to.
+	callbackHosts []string
+
+	// results stores the state of asynchronous commands.
+	results *asyncStore
+
+	// timeout is used when the push message gives no timeout, maxTimeout
+	// bounds the one it gives.
+	timeout    time.Duration
+	maxTimeout time.Duration
+
+	// cluster routes commands for users connected to other nodes, nil if
+	// the server runs alone.
+	cluster *cluster
 }
 
 // Authorize if needed. Then decode the request and push message to each
 // related websocket connection.
 func (s *pushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		writeError(w, ErrMethodNotAllowed)
 		return
 	}
 
 	// authorize
 	if s.authFunc != nil {
 		if ok := s.authFunc(r); !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeError(w, ErrUnauthorized)
 			return
 		}
 	}
 
+	if r.Method == http.MethodGet {
+		s.serveStatus(w, r)
+		return
+	}
+
 	// read request
-	var msg CommMessage
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&msg); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(ErrRequestIllegal.Error()))
+	msg, err := readCommMessage(r)
+	if err != nil {
+		writeError(w, ErrRequestIllegal)
 		return
 	}
 
-	// validate the data
-	if msg.UserID == "" || msg.CommID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(ErrRequestIllegal.Error()))
+	// validate the data, a message without userId targets every subscriber
+	// of the event
+	if (msg.UserID == "" && (msg.Event == "" || msg.Async)) || msg.CommID == "" ||
+		msg.Timeout < 0 || !checkMode(msg.Mode) || msg.content().empty() {
+		writeError(w, ErrRequestIllegal)
 		return
 	}
 
-	var obj *CommObject
-	var err error
+	if err := s.authorize(r, msg); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if msg.UserID == "" {
+		timeout := s.commandTimeout(msg.Timeout, false)
+		users := s.cm.subscribers(msg.Event)
+		// a command for each subscriber
+		if err := s.charge(r, len(users)); err != nil {
+			writeError(w, err)
+			return
+		}
+		results := s.pushMany(users, msg.CommID, msg.content(), msg.Mode, msg.Event, timeout)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+		return
+	}
 
-	defer s.cm.removeCommand(msg.UserID, msg.CommID)
+	if err := s.charge(r, 1); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if msg.Async {
+		s.pushAsync(w, r, msg)
+		return
+	}
 
-	obj, err = s.push(msg.UserID, msg.CommID, msg.Message)
+	timeout := s.commandTimeout(msg.Timeout, false)
+	obj, err := s.push(msg.UserID, msg.CommID, msg.content(), msg.Mode, msg.Event, timeout)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, err)
 		return
 	}
+	defer s.removeCommand(msg.UserID, msg.CommID)
 
-	d, _ := time.ParseDuration("1s")
-	err = s.wait(obj, d)
+	err = s.wait(obj)
 
-	// timeout
+	// timeout or the connection is gone
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, err)
 		return
 	}
 
-	result := strings.NewReader(obj.response.Msg)
-	io.Copy(w, result)
+	if obj.mode == PushAll {
+		obj.mu.Lock()
+		msgs := make([]json.RawMessage, len(obj.responses))
+		for i, resp := range obj.responses {
+			msgs[i] = resp.Msg
+			if len(resp.Data) > 0 {
+				msgs[i], _ = json.Marshal(resp.Data)
+			}
+		}
+		obj.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msgs)
+		return
+	}
+
+	writeResponse(w, obj.response)
+}
+
+// authorize checks the command by the policy. Errors other than
+// ErrUnauthorized and ErrTooManyRequests are rejected as ErrForbidden.
+func (s *pushHandler) authorize(r *http.Request, msg *CommMessage) error {
+	if s.policy == nil {
+		return nil
+	}
+	return policyError(s.policy(r, msg))
+}
+
+// charge charges the commands of the request, all of them authorized, by the
+// limit. Errors are rejected like the ones of authorize.
+func (s *pushHandler) charge(r *http.Request, commands int) error {
+	if s.limit == nil || commands == 0 {
+		return nil
+	}
+	return policyError(s.limit(r, commands))
+}
+
+// policyError makes err of a push hook ErrForbidden, unless it's
+// ErrUnauthorized or ErrTooManyRequests.
+func policyError(err error) error {
+	if err != nil && !errors.Is(err, ErrForbidden) && !errors.Is(err, ErrUnauthorized) &&
+		!errors.Is(err, ErrTooManyRequests) {
+		err = fmt.Errorf("%w: %v", ErrForbidden, err)
+	}
+	return err
+}
+
+// writeResponse copies the message of resp. It's JSON, except the text sent
+// by ProtocolVersion1 clients and binary data.
+func writeResponse(w http.ResponseWriter, resp *CommResponse) {
+	if len(resp.Data) > 0 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(resp.Data)
+		return
+	}
+	if resp.legacy {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(payload(resp.Msg))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(resp.Msg) == 0 {
+		w.Write([]byte("null"))
+		return
+	}
+	w.Write(resp.Msg)
+}
+
+// pushAsync pushes the message and responds 202 with the pending result
+// immediately. The response of the client is waited in background.
+func (s *pushHandler) pushAsync(w http.ResponseWriter, r *http.Request, msg *CommMessage) {
+	if msg.Callback != "" {
+		u, err := url.Parse(msg.Callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			writeError(w, ErrRequestIllegal)
+			return
+		}
+		if !matchAny(s.callbackHosts, u.Host) {
+			writeError(w, fmt.Errorf("%w: callback host %q not allowed", ErrForbidden, u.Host))
+			return
+		}
+	}
+
+	caller := s.caller(r)
+	if err := s.results.add(caller, msg.UserID, msg.CommID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	timeout := s.commandTimeout(msg.Timeout, true)
+	obj, err := s.push(msg.UserID, msg.CommID, msg.content(), msg.Mode, msg.Event, timeout)
+	if err != nil {
+		s.results.remove(caller, msg.CommID)
+		writeError(w, err)
+		return
+	}
+	obj.async = true
+
+	go s.waitAsync(obj, caller, msg.UserID, msg.Callback)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(s.results.get(caller, msg.CommID))
+}
+
+// serveStatus responds the result of an asynchronous command requested by
+// GET path/{commId}.
+func (s *pushHandler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, s.path+"/") {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	// results of other callers are not told to exist
+	commID := strings.TrimPrefix(r.URL.Path, s.path+"/")
+	res := s.results.get(s.caller(r), commID)
+	if res == nil {
+		writeError(w, ErrNoSuchCommand)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
 }
 
 // wait until the client give the response
 // push a command, wait or not
 // if wait, got a channel and wait on it
 // if not, return after the command is successfully pushed
-//
-func (s *pushHandler) wait(obj *CommObject, timeout time.Duration) error {
+func (s *pushHandler) wait(obj *CommObject) error {
+	return s.waitContext(context.Background(), obj)
+}
+
+// waitContext is like wait, but gives up when ctx is done and returns its
+// error.
+func (s *pushHandler) waitContext(ctx context.Context, obj *CommObject) error {
 
 	if obj == nil {
 		return errors.New("command object cannot be empty")
 	}
 
+	// the deadline may have passed while waiting for other commands, a
+	// response got in time must still win over the timer
 	select {
 	case <-obj.waitCH:
-		return nil
-	case <-time.After(timeout):
-		return errors.New("timeout waiting command response")
+		return obj.err
+	default:
+	}
+
+	timer := time.NewTimer(time.Until(obj.deadline()))
+	defer timer.Stop()
+
+	select {
+	case <-obj.waitCH:
+		return obj.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrTimeout
+	}
+
+}
+
+// commandTimeout converts the timeout in milliseconds given by the push
+// message to the duration to wait. Zero means the default one, which is the
+// maximum for asynchronous commands.
+func (s *pushHandler) commandTimeout(ms int64, async bool) time.Duration {
+	if ms <= 0 {
+		if async {
+			return s.maxTimeout
+		}
+		return s.timeout
 	}
 
+	d := time.Duration(ms) * time.Millisecond
+	if d > s.maxTimeout {
+		return s.maxTimeout
+	}
+	return d
 }
 
-func (s *pushHandler) push(userID, commID, message string) (*CommObject, error) {
+// push sends the command to connections of the user. If the user has no
+// connection to this node, or none subscribed to the event, the command is
+// routed through the cluster. A user connected to this node is only pushed to
+// its connections here, whatever the mode: "all" and "first" don't reach the
+// connections of other nodes, and "newest" picks the newest of this node.
+func (s *pushHandler) push(userID, commID string, body content, mode, event string, timeout time.Duration) (*CommObject, error) {
+	obj, err := s.pushLocal(userID, commID, body, mode, event, timeout)
+	if errors.Is(err, ErrUserNotConnected) && s.cluster != nil {
+		return s.cluster.push(userID, commID, body, s.defaultMode(mode), event, timeout)
+	}
+	return obj, err
+}
 
-	if userID == "" || commID == "" || message == "" {
-		return nil, errors.New("parameters(userId, event, message) can't be empty")
+// removeCommand forgets the command pushed by push.
+func (s *pushHandler) removeCommand(userID, commID string) {
+	if s.cm.removeCommand(userID, commID) != nil && s.cluster != nil {
+		s.cluster.remove(userID, commID)
 	}
+}
 
-	var obj *CommObject
-	var ok error
-	if obj, ok = s.cm.newCommand(userID, commID); ok != nil {
-		return nil, errors.New("create new command failed")
+// defaultMode returns PushNewest if mode is empty.
+func (s *pushHandler) defaultMode(mode string) string {
+	if mode == "" {
+		return PushNewest
 	}
+	return mode
+}
+
+// pushLocal sends the command to connections of the user on this node.
+func (s *pushHandler) pushLocal(userID, commID string, body content, mode, event string, timeout time.Duration) (*CommObject, error) {
+
+	if userID == "" || commID == "" || body.empty() {
+		return nil, fmt.Errorf("%w: userId, commId and one of message and data are required", ErrRequestIllegal)
+	}
+	mode = s.defaultMode(mode)
+
+	obj, err := s.cm.newCommand(userID, commID, mode, event)
+	if err != nil {
+		return nil, err
+	}
+	obj.start = time.Now()
+	obj.timeout = timeout
 
 	request := CommRequest{
-		Id:  commID,
-		Msg: message,
+		Id:       commID,
+		Msg:      body.msg,
+		Timeout:  int64(timeout / time.Millisecond),
+		Deadline: obj.deadline().UnixNano() / int64(time.Millisecond),
+		Data:     body.data,
+		NoReply:  body.noReply,
 	}
 	obj.request = &request
 	obj.id = commID
 
-	// filter connections by userID and event, then push message
-	conn := obj.conn
-	raw, _ := json.Marshal(&request)
-
-	_, err := conn.Write(raw)
+	// write message to each target connection, the command fails only if
+	// none of them can be written
+	obj.mu.Lock()
+	conns := append([]*Conn(nil), obj.conns...)
+	obj.mu.Unlock()
+
+	enc := newRequestEncoder(&request)
+	written := 0
+	for _, conn := range conns {
+		var p []byte
+		if p, err = enc.encode(conn); err == nil {
+			_, err = conn.Write(p)
+		}
+		if err != nil {
+			obj.detach(conn, err)
+			continue
+		}
+		written++
+	}
 
-	if err != nil {
+	if written == 0 {
+		s.cm.removeCommand(userID, commID)
 		return nil, err
 	}
 
 	return obj, nil
 }
 
+// pushMany pushes the command to each user, then waits for all of them. The
+// result of each user is returned by userID. In PushAll mode the message of
+// a user is the one from its first responding connection.
+func (s *pushHandler) pushMany(userIDs []string, commID string, body content, mode, event string, timeout time.Duration) map[string]*PushResult {
+	results := make(map[string]*PushResult, len(userIDs))
+	objs := make(map[string]*CommObject, len(userIDs))
+
+	for _, userID := range userIDs {
+		obj, err := s.push(userID, commID, body, mode, event, timeout)
+		if err != nil {
+			results[userID] = &PushResult{Error: err.Error(), Code: errorCode(err)}
+			continue
+		}
+		objs[userID] = obj
+	}
+
+	// commands share the same deadline, so waiting one by one costs no more
+	// than the timeout
+	for userID, obj := range objs {
+		if err := s.wait(obj); err != nil {
+			results[userID] = &PushResult{Error: err.Error(), Code: errorCode(err)}
+		} else {
+			results[userID] = &PushResult{Message: obj.response.Msg, Data: obj.response.Data}
+		}
+		s.removeCommand(userID, commID)
+	}
+
+	return results
+}
+
+// checkMode reports whether mode is a known push mode, empty means the
+// default one.
+func checkMode(mode string) bool {
+	switch mode {
+	case "", PushNewest, PushFirst, PushAll:
+		return true
+	}
+	return false
+}
+
+// SubscribeMessage defines message struct client send to subscribe or
+// unsubscribe events after registered.
+type SubscribeMessage struct {
+	Events []string `json:"events"`
+}
+
+// PushResult is the outcome of a command pushed to one of several users.
+type PushResult struct {
+	Message json.RawMessage `json:"message,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Code    string          `json:"code,omitempty"`
+}
+
 // PushMessage defines message struct send by client to push to each connected
 // websocket client.
 type PushMessage struct {
@@ -219,8 +781,85 @@ type PushMessage struct {
 	Message string
 }
 
+// CommMessage defines message struct send by client to push a command to the
+// websocket connection of a user.
+//
+// Timeout is how long to wait for the response in milliseconds. It's bounded
+// by Server.MaxPushTimeout, and Server.PushTimeout is used if it's zero.
+//
+// If Event is not empty, only connections subscribed to it receive the
+// command. Without UserID, the command is sent to every user subscribed to
+// Event and the response is a JSON object with a PushResult by userID.
+//
+// Mode decides which connections of the user receive the command, it's one of
+// PushNewest (default), PushFirst and PushAll. In PushAll mode the response is
+// a JSON array with the message of each connection.
+//
+// Message is any JSON value. ProtocolVersion2 clients receive it as it is,
+// ProtocolVersion1 clients receive it as a JSON string. The response of a
+// ProtocolVersion2 client is returned as JSON, the one of a ProtocolVersion1
+// client as text.
+//
+// Data is binary data pushed instead of Message, it's base64 encoded in
+// JSON. A request with Content-Type application/octet-stream pushes its body
+// as Data, other fields are given as query parameters of the same names.
+// Clients negotiating a binary Codec receive it in binary frames. A binary
+// response of the client is returned with Content-Type
+// application/octet-stream.
+//
+// If Async is true, the request returns 202 immediately. The result can be
+// fetched from PushPath + "/{commId}" by the same caller, and is also posted
+// to Callback if it's not empty. The host of Callback must be allowed by
+// Server.CallbackHosts.
 type CommMessage struct {
-	UserID  string `json:"userId"`
-	CommID  string `json:"commId"`
-	Message string `json:"message"`
+	UserID   string          `json:"userId"`
+	Event    string          `json:"event,omitempty"`
+	CommID   string          `json:"commId"`
+	Message  json.RawMessage `json:"message,omitempty"`
+	Data     []byte          `json:"data,omitempty"`
+	Timeout  int64           `json:"timeout,omitempty"`
+	Mode     string          `json:"mode,omitempty"`
+	Async    bool            `json:"async,omitempty"`
+	Callback string          `json:"callback,omitempty"`
+}
+
+// content returns what the message pushes.
+func (m *CommMessage) content() content {
+	return content{msg: m.Message, data: m.Data}
+}
+
+// readCommMessage reads the CommMessage of a push request. It's the JSON
+// body, or the query of a request with Content-Type application/octet-stream
+// whose body is the data.
+func readCommMessage(r *http.Request) (*CommMessage, error) {
+	msg := &CommMessage{}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/octet-stream" {
+		if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	q := r.URL.Query()
+	msg.UserID = q.Get("userId")
+	msg.Event = q.Get("event")
+	msg.CommID = q.Get("commId")
+	msg.Mode = q.Get("mode")
+	msg.Callback = q.Get("callback")
+
+	var err error
+	if v := q.Get("timeout"); v != "" {
+		if msg.Timeout, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("async"); v != "" {
+		if msg.Async, err = strconv.ParseBool(v); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Data, err = io.ReadAll(r.Body); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
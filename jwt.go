@@ -0,0 +1,416 @@
+package wserver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTAuth verifies JSON Web Tokens signed with HS256, RS256 or ES256. It
+// provides the hooks of Server authenticating clients and push requests:
+//
+//	auth, err := wserver.NewJWTAuth("public.pem")
+//	auth.Issuer = "https://auth.example.com"
+//	server.VerifyToken = auth.VerifyToken
+//	server.AuthRequest = auth.AuthRequest
+//	server.PushAuth = auth.PushAuth
+//
+// Connections are closed when their token expires.
+type JWTAuth struct {
+	// Issuer and Audience are checked against "iss" and "aud" of tokens if
+	// they're not empty.
+	Issuer   string
+	Audience string
+
+	// UserClaim is the claim giving the userID, default "sub".
+	UserClaim string
+
+	// Leeway is the clock skew allowed checking "exp" and "nbf".
+	Leeway time.Duration
+
+	// Cookie is the name of the cookie holding the token in upgrade
+	// requests, if it's not empty. See AuthRequest.
+	Cookie string
+
+	keys []jwtKey
+}
+
+// jwtKey is a key verifying tokens of alg. The id matches "kid" of tokens,
+// empty matches any.
+type jwtKey struct {
+	id  string
+	alg string
+	key interface{}
+}
+
+// NewJWTAuth loads the key from file. It's a PEM encoded RSA or EC public key
+// or certificate, for RS256 or ES256, otherwise the whole file is the secret
+// of HS256.
+func NewJWTAuth(file string) (*JWTAuth, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return NewHMACAuth(bytes.TrimRight(data, "\r\n")), nil
+	}
+
+	var pub interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	key, err := newJWTKey("", pub)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &JWTAuth{keys: []jwtKey{key}}, nil
+}
+
+// NewHMACAuth verifies tokens signed with secret by HS256.
+func NewHMACAuth(secret []byte) *JWTAuth {
+	return &JWTAuth{keys: []jwtKey{{alg: "HS256", key: secret}}}
+}
+
+// NewJWKSAuth loads the keys from file, which is a JSON Web Key Set. RSA keys,
+// EC keys of P-256 and symmetric keys are used, others are skipped.
+func NewJWKSAuth(file string) (*JWTAuth, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	auth := &JWTAuth{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var pub interface{}
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := decodeBigInt(k.N)
+			e, err2 := decodeBigInt(k.E)
+			if err1 != nil || err2 != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("%s: malformed RSA key %s", file, k.Kid)
+			}
+			pub = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := decodeBigInt(k.X)
+			y, err2 := decodeBigInt(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("%s: malformed EC key %s", file, k.Kid)
+			}
+			pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		case k.Kty == "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("%s: malformed symmetric key %s", file, k.Kid)
+			}
+			pub = secret
+		default:
+			continue
+		}
+
+		key, err := newJWTKey(k.Kid, pub)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		auth.keys = append(auth.keys, key)
+	}
+	if len(auth.keys) == 0 {
+		return nil, fmt.Errorf("%s: no usable key", file)
+	}
+	return auth, nil
+}
+
+func newJWTKey(id string, pub interface{}) (jwtKey, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jwtKey{id, "RS256", pub}, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return jwtKey{}, errors.New("EC key must be on curve P-256")
+		}
+		return jwtKey{id, "ES256", pub}, nil
+	case []byte:
+		return jwtKey{id, "HS256", pub}, nil
+	}
+	return jwtKey{}, fmt.Errorf("unsupported key type %T", pub)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// VerifyToken verifies token and returns the userID and claims in it. It
+// fails with ErrTokenExpired if the token is expired, or ErrInvalidToken.
+// It's for Server.VerifyToken.
+func (a *JWTAuth) VerifyToken(token string) (string, map[string]interface{}, error) {
+	claims, err := a.verify(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	userClaim := a.UserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	var userID string
+	switch v := claims[userClaim].(type) {
+	case string:
+		userID = v
+	case json.Number:
+		userID = v.String()
+	}
+	if userID == "" {
+		return "", nil, fmt.Errorf("%w: no claim %s", ErrInvalidToken, userClaim)
+	}
+	return userID, claims, nil
+}
+
+// AuthToken verifies token like VerifyToken, it's for Server.AuthToken.
+func (a *JWTAuth) AuthToken(token string) (string, bool) {
+	userID, _, err := a.VerifyToken(token)
+	return userID, err == nil
+}
+
+// AuthRequest verifies the token of the upgrade request, it's for
+// Server.AuthRequest. The token is given as bearer token in the Authorization
+// header, or a subprotocol "bearer.{token}" since browsers can't set headers
+// of websocket requests, or in Cookie.
+func (a *JWTAuth) AuthRequest(r *http.Request) (string, map[string]interface{}, error) {
+	token := a.requestToken(r)
+	if token == "" {
+		return "", nil, fmt.Errorf("%w: no token", ErrUnauthorized)
+	}
+	return a.VerifyToken(token)
+}
+
+// PushAuth reports whether the push request has a valid bearer token in the
+// Authorization header, it's for Server.PushAuth.
+func (a *JWTAuth) PushAuth(r *http.Request) bool {
+	_, err := a.verify(bearerToken(r))
+	return err == nil
+}
+
+func (a *JWTAuth) requestToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+
+	for _, p := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if p = strings.TrimSpace(p); strings.HasPrefix(p, "bearer.") {
+			return strings.TrimPrefix(p, "bearer.")
+		}
+	}
+
+	if a.Cookie != "" {
+		if c, err := r.Cookie(a.Cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// bearerToken returns the bearer token of the Authorization header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// verify checks the signature and registered claims of token, then returns
+// its claims.
+func (a *JWTAuth) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	// the algorithm must be the one of the key, so a public key is never
+	// used as HMAC secret
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range a.keys {
+		if k.alg != header.Alg || (header.Kid != "" && k.id != "" && k.id != header.Kid) {
+			continue
+		}
+		if verifyJWTSignature(k, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes the JSON of a part of token into v, numbers are kept
+// as json.Number.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	return nil
+}
+
+func verifyJWTSignature(k jwtKey, signed, sig []byte) bool {
+	sum := sha256.Sum256(signed)
+
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, sum[:], r, s)
+	}
+	return false
+}
+
+func (a *JWTAuth) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	if exp, ok := claimTime(claims, "exp"); ok && !now.Before(exp.Add(a.Leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Add(a.Leeway).Before(nbf) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return fmt.Errorf("%w: bad issuer", ErrInvalidToken)
+	}
+
+	if a.Audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == a.Audience
+		case []interface{}:
+			for _, v := range aud {
+				if v == a.Audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: bad audience", ErrInvalidToken)
+		}
+	}
+	return nil
+}
+
+// claimTime returns the time of the NumericDate claim name.
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	var sec float64
+	switch v := claims[name].(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		sec = f
+	case float64:
+		sec = v
+	case int64:
+		sec = float64(v)
+	case time.Time:
+		return v, true
+	default:
+		return time.Time{}, false
+	}
+	// split, nanoseconds of far times overflow int64
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9)), true
+}
@@ -0,0 +1,305 @@
+package wserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_JWT_HMAC(t *testing.T) {
+	file := writeTempFile(t, "secret", []byte("s3cret\n"))
+	auth, err := NewJWTAuth(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Issuer = "issuer"
+	auth.Audience = "wserver"
+	auth.UserClaim = "uid"
+
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name   string
+		token  string
+		userID string
+		err    error
+	}{
+		{"valid", signJWT(t, "HS256", "", []byte("s3cret"), map[string]interface{}{
+			"uid": "alice", "iss": "issuer", "aud": []string{"other", "wserver"}, "exp": exp,
+		}), "alice", nil},
+		{"bad secret", signJWT(t, "HS256", "", []byte("guess"), map[string]interface{}{
+			"uid": "alice", "iss": "issuer", "aud": "wserver", "exp": exp,
+		}), "", ErrInvalidToken},
+		{"expired", signJWT(t, "HS256", "", []byte("s3cret"), map[string]interface{}{
+			"uid": "alice", "iss": "issuer", "aud": "wserver", "exp": time.Now().Add(-time.Minute).Unix(),
+		}), "", ErrTokenExpired},
+		{"bad issuer", signJWT(t, "HS256", "", []byte("s3cret"), map[string]interface{}{
+			"uid": "alice", "iss": "mallory", "aud": "wserver",
+		}), "", ErrInvalidToken},
+		{"bad audience", signJWT(t, "HS256", "", []byte("s3cret"), map[string]interface{}{
+			"uid": "alice", "iss": "issuer", "aud": "other",
+		}), "", ErrInvalidToken},
+		{"no user", signJWT(t, "HS256", "", []byte("s3cret"), map[string]interface{}{
+			"sub": "alice", "iss": "issuer", "aud": "wserver",
+		}), "", ErrInvalidToken},
+		{"far future", signJWT(t, "HS256", "", []byte("s3cret"), map[string]interface{}{
+			"uid": "alice", "iss": "issuer", "aud": "wserver", "exp": 9999999999,
+		}), "alice", nil},
+		{"malformed", "a.b", "", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		userID, _, err := auth.VerifyToken(tt.token)
+		if userID != tt.userID || !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+			t.Errorf("%s: got %q %v", tt.name, userID, err)
+		}
+	}
+
+	if exp, _ := claimTime(map[string]interface{}{"exp": 9999999999.5}, "exp"); exp.Year() != 2286 || exp.Nanosecond() != 5e8 {
+		t.Errorf("far future exp decoded as %v", exp)
+	}
+}
+
+func Test_JWT_PublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	pemFile := writeTempFile(t, "rsa.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	rsaAuth, err := NewJWTAuth(pemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, _, err := rsaAuth.VerifyToken(signJWT(t, "RS256", "", rsaKey, map[string]interface{}{"sub": "bob"})); err != nil || userID != "bob" {
+		t.Fatalf("RS256: %q %v", userID, err)
+	}
+	// the public key must not be taken as HMAC secret
+	forged := signJWT(t, "HS256", "", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), map[string]interface{}{"sub": "bob"})
+	if _, _, err := rsaAuth.VerifyToken(forged); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("HS256 signed by the public key: %v", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA", "kid": "r1",
+				"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e": "AQAB",
+			},
+			{
+				"kty": "EC", "kid": "e1", "crv": "P-256",
+				"x": base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y": base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+	jwksAuth, err := NewJWKSAuth(writeTempFile(t, "jwks.json", jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, _, err := jwksAuth.VerifyToken(signJWT(t, "ES256", "e1", ecKey, map[string]interface{}{"sub": "carol"})); err != nil || userID != "carol" {
+		t.Fatalf("ES256: %q %v", userID, err)
+	}
+	if userID, _, err := jwksAuth.VerifyToken(signJWT(t, "RS256", "r1", rsaKey, map[string]interface{}{"sub": "dave"})); err != nil || userID != "dave" {
+		t.Fatalf("RS256 from JWKS: %q %v", userID, err)
+	}
+	if _, _, err := jwksAuth.VerifyToken(signJWT(t, "RS256", "e1", rsaKey, map[string]interface{}{"sub": "dave"})); err == nil {
+		t.Fatal("token of another kid accepted")
+	}
+}
+
+func Test_JWT_Server(t *testing.T) {
+	secret := []byte("s3cret")
+	auth := NewHMACAuth(secret)
+
+	s := NewServer("")
+	s.VerifyToken = auth.VerifyToken
+	s.PushAuth = auth.PushAuth
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	// the connection is closed when its token expires
+	exp := float64(time.Now().Add(300*time.Millisecond).UnixNano()) / float64(time.Second)
+	token := signJWT(t, "HS256", "", secret, map[string]interface{}{"sub": "alice", "exp": exp})
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rm, _ := json.Marshal(RegisterMessage{Token: token})
+	c.WriteJSON(WSMessage{Kind: RegisterMessageType, Body: rm})
+	waitConns(t, s, "alice", 1)
+
+	// the push needs a token as well
+	push := func(token string) int {
+		b, _ := json.Marshal(CommMessage{UserID: "alice", CommID: "1", Message: jsonString("hi"), Timeout: 50})
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+s.PushPath, strings.NewReader(string(b)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := push(""); status != http.StatusUnauthorized {
+		t.Fatalf("push without token: %d", status)
+	}
+	if status := push(signJWT(t, "HS256", "", secret, map[string]interface{}{"sub": "svc"})); status != http.StatusGatewayTimeout {
+		t.Fatalf("push with token: %d", status)
+	}
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.ClosePolicyViolation || ce.Text != CodeTokenExpired {
+			t.Fatalf("closed with %v", err)
+		}
+		break
+	}
+}
+
+func Test_JWT_Reauth(t *testing.T) {
+	secret := []byte("s3cret")
+	auth := NewHMACAuth(secret)
+
+	s := NewServer("")
+	s.VerifyToken = auth.VerifyToken
+	s.ReauthNotice = 200 * time.Millisecond
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	token := func(userID string, ttl time.Duration) string {
+		exp := float64(time.Now().Add(ttl).UnixNano()) / float64(time.Second)
+		return signJWT(t, "HS256", "", secret, map[string]interface{}{"sub": userID, "exp": exp})
+	}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	// read returns the next frame, which must be about auth
+	read := func() *CommRequest {
+		var cr CommRequest
+		if err := c.ReadJSON(&cr); err != nil {
+			t.Fatal(err)
+		}
+		return &cr
+	}
+	reauth := func(token string) *AuthStatus {
+		body, _ := json.Marshal(ReauthMessage{Token: token})
+		c.WriteJSON(WSMessage{Kind: ReauthMessageType, Body: body})
+		cr := read()
+		if cr.Auth == nil {
+			t.Fatalf("reauth answered %+v", cr)
+		}
+		return cr.Auth
+	}
+
+	rm, _ := json.Marshal(RegisterMessage{Token: token("alice", 400*time.Millisecond), Version: ProtocolVersion2})
+	c.WriteJSON(WSMessage{Kind: RegisterMessageType, Body: rm})
+	if cr := read(); cr.Register == nil || cr.Register.Status != CommStatusOK {
+		t.Fatalf("register answered %+v", cr)
+	}
+
+	// told before the token expires
+	if cr := read(); cr.Auth == nil || cr.Auth.Status != AuthStatusExpiring {
+		t.Fatalf("got %+v, want expiring notice", cr)
+	}
+	if st := reauth(token("alice", time.Hour)); st.Status != CommStatusOK ||
+		time.Until(time.Unix(0, st.Expires*int64(time.Millisecond))) < 59*time.Minute {
+		t.Fatalf("reauth answered %+v", st)
+	}
+	if st := reauth(token("bob", time.Hour)); st.Status != CommStatusError || st.Code != CodeInvalidToken {
+		t.Fatalf("reauth of another user answered %+v", st)
+	}
+
+	// kept open after the first token expires
+	time.Sleep(300 * time.Millisecond)
+	if found, _ := s.wh.cm.hasUser("alice"); !found {
+		t.Fatal("connection closed with the first token")
+	}
+
+	if n := s.Reauth("alice", 100*time.Millisecond); n != 1 {
+		t.Fatalf("reauth asked %d connections", n)
+	}
+	if cr := read(); cr.Auth == nil || cr.Auth.Status != AuthStatusRequired {
+		t.Fatalf("got %+v, want reauth required", cr)
+	}
+	_, _, err = c.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.ClosePolicyViolation || ce.Text != CodeTokenExpired {
+		t.Fatalf("closed with %v", err)
+	}
+}
+
+// signJWT returns a token of claims signed by key with alg.
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, key, sum[:])
+		sig, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), e
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
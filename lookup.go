@@ -0,0 +1,210 @@
+package wserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	lookupDefaultLimit = 100
+	lookupMaxLimit     = 1000
+)
+
+// ConnInfo describes a websocket connection of a user.
+type ConnInfo struct {
+	ID          string    `json:"id"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	Events      []string  `json:"events,omitempty"`
+
+	// Pending is the number of commands waiting for the response of the
+	// connection.
+	Pending int `json:"pending"`
+}
+
+// Presence describes whether a user is connected to this server and its
+// connections.
+type Presence struct {
+	UserID string     `json:"userId"`
+	Online bool       `json:"online"`
+	Conns  []ConnInfo `json:"conns,omitempty"`
+}
+
+// LookupMessage defines message struct send by client to look up several
+// users at once.
+type LookupMessage struct {
+	UserIDs []string `json:"userIds"`
+}
+
+// PresenceList is a page of connected users, sorted by userID.
+type PresenceList struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Users  []*Presence `json:"users"`
+}
+
+// lookupHandler defines to handle presence request.
+type lookupHandler struct {
+	// authFunc defines to authorize request. The request will proceed only
+	// when it returns true.
+	authFunc func(r *http.Request) bool
+	cm       *CommManager
+
+	// authorize checks the users looked up by Server.PushPolicy, without
+	// userID if all of them are listed.
+	authorize func(r *http.Request, msg *CommMessage) error
+}
+
+// Authorize if needed. Then respond presence of users:
+//
+// GET ?userid=xxx looks up one user, 404 if it's not connected.
+// GET ?offset=0&limit=100 lists connected users page by page.
+// POST with LookupMessage looks up several users.
+func (lh *lookupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+
+	// authorize
+	if lh.authFunc != nil {
+		if ok := lh.authFunc(r); !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+	}
+
+	var result interface{}
+
+	if r.Method == http.MethodPost {
+		var msg LookupMessage
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&msg); err != nil || len(msg.UserIDs) == 0 {
+			writeError(w, ErrRequestIllegal)
+			return
+		}
+		userIDs := dedup(msg.UserIDs)
+		for _, userID := range userIDs {
+			if err := lh.authorize(r, &CommMessage{UserID: userID}); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		result = lh.cm.presences(userIDs)
+	} else if userID := r.URL.Query().Get("userid"); userID != "" {
+		if err := lh.authorize(r, &CommMessage{UserID: userID}); err != nil {
+			writeError(w, err)
+			return
+		}
+		p := lh.cm.presence(userID)
+		if !p.Online {
+			writeError(w, ErrUserNotConnected)
+			return
+		}
+		result = p
+	} else {
+		offset, err1 := queryInt(r, "offset", 0)
+		limit, err2 := queryInt(r, "limit", lookupDefaultLimit)
+		if err1 != nil || err2 != nil || offset < 0 || limit <= 0 {
+			writeError(w, ErrRequestIllegal)
+			return
+		}
+		if limit > lookupMaxLimit {
+			limit = lookupMaxLimit
+		}
+		if err := lh.authorize(r, &CommMessage{}); err != nil {
+			writeError(w, err)
+			return
+		}
+		result = lh.cm.list(offset, limit)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// queryInt parses the query parameter key as int, def is returned if absent.
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// presence returns the presence of userID.
+func (m *CommManager) presence(userID string) *Presence {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.presenceLocked(userID)
+}
+
+// presences returns the presence of each user in userIDs.
+func (m *CommManager) presences(userIDs []string) []*Presence {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ps := make([]*Presence, len(userIDs))
+	for i, userID := range userIDs {
+		ps[i] = m.presenceLocked(userID)
+	}
+	return ps
+}
+
+// list returns a page of connected users sorted by userID.
+func (m *CommManager) list(offset, limit int) *PresenceList {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	userIDs := make([]string, 0, len(m.userConnCommMap))
+	for userID := range m.userConnCommMap {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	pl := &PresenceList{
+		Total:  len(userIDs),
+		Offset: offset,
+		Users:  []*Presence{},
+	}
+	for i := offset; i < len(userIDs) && i < offset+limit; i++ {
+		pl.Users = append(pl.Users, m.presenceLocked(userIDs[i]))
+	}
+	return pl
+}
+
+// presenceLocked must be called with m.mu held.
+func (m *CommManager) presenceLocked(userID string) *Presence {
+	p := &Presence{UserID: userID}
+
+	cc, ok := m.userConnCommMap[userID]
+	if !ok {
+		return p
+	}
+	p.Online = true
+
+	for _, conn := range cc.conns {
+		info := ConnInfo{
+			ID:          conn.GetID(),
+			ConnectedAt: conn.connectedAt,
+			RemoteAddr:  conn.Conn.RemoteAddr().String(),
+		}
+		for event := range conn.events {
+			info.Events = append(info.Events, event)
+		}
+		sort.Strings(info.Events)
+
+		for _, obj := range cc.commMap {
+			if obj.waiting(conn) {
+				info.Pending++
+			}
+		}
+		p.Conns = append(p.Conns, info)
+	}
+
+	return p
+}
@@ -0,0 +1,431 @@
+package wserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// msgpackMaxDepth is the nesting of arrays and maps decoded at most, like the
+// one of encoding/json.
+const msgpackMaxDepth = 10000
+
+// MsgPackCodec encodes messages as MessagePack maps in binary frames, keyed
+// like their JSON form. Messages of commands are converted between JSON and
+// MessagePack, and binary data is sent as bin.
+type MsgPackCodec struct{}
+
+// Name implements Codec.
+func (MsgPackCodec) Name() string {
+	return "wserver.msgpack"
+}
+
+// MessageType implements Codec.
+func (MsgPackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+// Marshal implements Codec.
+func (MsgPackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch v := v.(type) {
+	case *CommRequest:
+		var fields []msgpackField
+		if v.Id != "" {
+			fields = append(fields, msgpackField{"id", v.Id})
+		}
+		if len(v.Msg) > 0 {
+			fields = append(fields, msgpackField{"msg", v.Msg})
+		}
+		if v.Timeout != 0 {
+			fields = append(fields, msgpackField{"timeout", v.Timeout})
+		}
+		if v.Deadline != 0 {
+			fields = append(fields, msgpackField{"deadline", v.Deadline})
+		}
+		if len(v.Data) > 0 {
+			fields = append(fields, msgpackField{"data", v.Data})
+		}
+		if v.NoReply {
+			fields = append(fields, msgpackField{"noReply", true})
+		}
+		if v.Reply != nil {
+			raw, err := json.Marshal(v.Reply)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, msgpackField{"reply", json.RawMessage(raw)})
+		}
+		if v.Register != nil {
+			raw, err := json.Marshal(v.Register)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, msgpackField{"register", json.RawMessage(raw)})
+		}
+		if v.Auth != nil {
+			raw, err := json.Marshal(v.Auth)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, msgpackField{"auth", json.RawMessage(raw)})
+		}
+		if err := encodeMsgPackFields(&buf, fields); err != nil {
+			return nil, err
+		}
+	case *WSMessage:
+		fields := []msgpackField{{"Kind", int64(v.Kind)}, {"Body", v.Body}}
+		if err := encodeMsgPackFields(&buf, fields); err != nil {
+			return nil, err
+		}
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := encodeMsgPack(&buf, json.RawMessage(raw)); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec. The message is converted to JSON, bin becomes
+// base64 string which is decoded into []byte fields.
+func (MsgPackCodec) Unmarshal(data []byte, wm *WSMessage) error {
+	r := bytes.NewReader(data)
+	v, err := decodeMsgPack(r, 0)
+	if err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return errors.New("msgpack: trailing data")
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, wm)
+}
+
+type msgpackField struct {
+	key   string
+	value interface{}
+}
+
+func encodeMsgPackFields(buf *bytes.Buffer, fields []msgpackField) error {
+	writeMsgPackHeader(buf, len(fields), 0x80, 0xde, 0xdf)
+	for _, f := range fields {
+		encodeMsgPack(buf, f.key)
+		if err := encodeMsgPack(buf, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMsgPack writes v, which is a JSON value (json.RawMessage, or any
+// produced by decoding JSON with UseNumber), int64 or []byte.
+func encodeMsgPack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int64:
+		writeMsgPackInt(buf, v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgPackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []byte:
+		n := len(v)
+		switch {
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xc4)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xc5)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xc6)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.Write(v)
+	case []interface{}:
+		writeMsgPackHeader(buf, len(v), 0x90, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := encodeMsgPack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeMsgPackHeader(buf, len(v), 0x80, 0xde, 0xdf)
+		for _, k := range keys {
+			encodeMsgPack(buf, k)
+			if err := encodeMsgPack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	case json.RawMessage:
+		if len(v) == 0 {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		var value interface{}
+		if err := d.Decode(&value); err != nil {
+			return err
+		}
+		return encodeMsgPack(buf, value)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// writeMsgPackHeader writes the header of an array or map of n elements,
+// fix is the prefix of the fix format, b16 and b32 the ones of others.
+func writeMsgPackHeader(buf *bytes.Buffer, n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgPackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// decodeMsgPack reads a value. Maps are decoded into map[string]interface{},
+// bin into []byte and numbers into int64, uint64 or float64. depth is the
+// nesting of the value, it fails past msgpackMaxDepth.
+func decodeMsgPack(r *bytes.Reader, depth int) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return decodeMsgPackMap(r, int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return decodeMsgPackArray(r, int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return readMsgPackString(r, int(b&0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMsgPackLen(r, b-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgPackBytes(r, n)
+	case 0xca:
+		var f uint32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(math.Float32frombits(f)), err
+	case 0xcb:
+		var f uint64
+		err := binary.Read(r, binary.BigEndian, &f)
+		return math.Float64frombits(f), err
+	case 0xcc:
+		var i uint8
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xcd:
+		var i uint16
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xce:
+		var i uint32
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xcf:
+		var i uint64
+		err := binary.Read(r, binary.BigEndian, &i)
+		return i, err
+	case 0xd0:
+		var i int8
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd1:
+		var i int16
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd2:
+		var i int32
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd3:
+		var i int64
+		err := binary.Read(r, binary.BigEndian, &i)
+		return i, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMsgPackLen(r, b-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgPackString(r, n)
+	case 0xdc, 0xdd:
+		n, err := readMsgPackLen(r, b-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgPackArray(r, n, depth)
+	case 0xde, 0xdf:
+		n, err := readMsgPackLen(r, b-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgPackMap(r, n, depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", b)
+}
+
+// readMsgPackLen reads a length of 1, 2 or 4 bytes by size 0, 1 or 2.
+func readMsgPackLen(r *bytes.Reader, size byte) (int, error) {
+	switch size {
+	case 0:
+		var n uint8
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	case 1:
+		var n uint16
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	default:
+		var n uint32
+		err := binary.Read(r, binary.BigEndian, &n)
+		return int(n), err
+	}
+}
+
+func readMsgPackBytes(r *bytes.Reader, n int) ([]byte, error) {
+	if n > r.Len() {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	p := make([]byte, n)
+	r.Read(p)
+	return p, nil
+}
+
+func readMsgPackString(r *bytes.Reader, n int) (string, error) {
+	p, err := readMsgPackBytes(r, n)
+	return string(p), err
+}
+
+func decodeMsgPackArray(r *bytes.Reader, n, depth int) ([]interface{}, error) {
+	if depth >= msgpackMaxDepth {
+		return nil, errors.New("msgpack: exceeded max depth")
+	}
+	if n > r.Len() {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	arr := make([]interface{}, n)
+	for i := range arr {
+		v, err := decodeMsgPack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func decodeMsgPackMap(r *bytes.Reader, n, depth int) (map[string]interface{}, error) {
+	if depth >= msgpackMaxDepth {
+		return nil, errors.New("msgpack: exceeded max depth")
+	}
+	if n > r.Len() {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := decodeMsgPack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeMsgPack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := k.(string); ok {
+			m[s] = v
+		} else {
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
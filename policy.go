@@ -0,0 +1,229 @@
+package wserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// PushRules authorizes push requests by rules loaded from a JSON file. Each
+// rule identifies a caller by its API key or the subject of its verified
+// client certificate, and limits the users and events it pushes to, and how
+// often:
+//
+//	{
+//	    "rules": [
+//	        {"apiKey": "k3y", "users": ["*"], "events": ["billing.*"], "rate": 10},
+//	        {"subject": "reports", "users": ["admin-*"], "events": ["*"]}
+//	    ]
+//	}
+//
+// It provides the hooks of Server:
+//
+//	rules, err := wserver.NewPushRules("push-rules.json")
+//	server.PushAuth = rules.PushAuth
+//	server.PushPolicy = rules.PushPolicy
+//	server.PushLimit = rules.PushLimit
+//	server.PushCaller = rules.PushCaller
+type PushRules struct {
+	// Header is the header of push requests giving the API key, default
+	// "X-API-Key".
+	Header string
+
+	rules []*pushRule
+}
+
+// pushRule is a rule of PushRules.
+//
+// Users and Events are patterns of path.Match. A push without userId is
+// allowed by a pattern matching the empty user, like "*", and so is a push
+// without event. Rate is the number of commands allowed per second, with
+// bursts of Burst, it's not limited if zero. A multicast counts a command for
+// each user, and so does a push to the subscribers of an event. A request of
+// more commands than Burst is never allowed.
+type pushRule struct {
+	APIKey  string   `json:"apiKey"`
+	Subject string   `json:"subject"`
+	Users   []string `json:"users"`
+	Events  []string `json:"events"`
+	Rate    float64  `json:"rate"`
+	Burst   int      `json:"burst"`
+
+	// name identifies the caller of the rule, see PushCaller
+	name string
+
+	// tokens left in the bucket at last
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewPushRules loads the rules from file. A rule gives either apiKey or
+// subject, which is the common name or the distinguished name of the client
+// certificate. Burst defaults to the rate rounded up.
+func NewPushRules(file string) (*PushRules, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf struct {
+		Rules []*pushRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	for i, rule := range conf.Rules {
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %v", file, i, err)
+		}
+		if rule.Burst == 0 {
+			rule.Burst = int(math.Ceil(rule.Rate))
+		}
+		rule.tokens = float64(rule.Burst)
+		rule.name = fmt.Sprintf("rule %d", i)
+	}
+	return &PushRules{rules: conf.Rules}, nil
+}
+
+func (rule *pushRule) check() error {
+	if (rule.APIKey == "") == (rule.Subject == "") {
+		return errors.New("either apiKey or subject must be given")
+	}
+	if rule.Rate < 0 || rule.Burst < 0 {
+		return errors.New("negative rate")
+	}
+	for _, p := range append(rule.Users, rule.Events...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// PushAuth reports whether the caller of the push request has a rule, it's
+// for Server.PushAuth.
+func (p *PushRules) PushAuth(r *http.Request) bool {
+	return p.caller(r) != nil
+}
+
+// PushCaller returns the caller of the push request as the rule identifying
+// it, or empty for unknown callers. It's for Server.PushCaller, so results of
+// asynchronous pushes are only served to the caller of the same rule.
+func (p *PushRules) PushCaller(r *http.Request) string {
+	if rule := p.caller(r); rule != nil {
+		return rule.name
+	}
+	return ""
+}
+
+// PushPolicy checks the command against the rule of the caller, it's for
+// Server.PushPolicy. Unknown callers fail with ErrUnauthorized, commands not
+// allowed with ErrForbidden telling why. Drop and lookup requests, having no
+// command, are checked for the event only if they give one.
+func (p *PushRules) PushPolicy(r *http.Request, msg *CommMessage) error {
+	rule := p.caller(r)
+	if rule == nil {
+		return fmt.Errorf("%w: unknown caller", ErrUnauthorized)
+	}
+
+	if !matchAny(rule.Users, msg.UserID) {
+		if msg.UserID == "" {
+			return fmt.Errorf("%w: push to every user not allowed", ErrForbidden)
+		}
+		return fmt.Errorf("%w: push to user %q not allowed", ErrForbidden, msg.UserID)
+	}
+	// lookups and drops have no command, and may have no event
+	if (msg.Event != "" || !msg.content().empty()) && !matchAny(rule.Events, msg.Event) {
+		if msg.Event == "" {
+			return fmt.Errorf("%w: push without event not allowed", ErrForbidden)
+		}
+		return fmt.Errorf("%w: push to event %q not allowed", ErrForbidden, msg.Event)
+	}
+	return nil
+}
+
+// PushLimit takes the commands from the rate of the rule of the caller, it's
+// for Server.PushLimit. They're taken all or none, commands beyond the rate
+// fail with ErrTooManyRequests.
+func (p *PushRules) PushLimit(r *http.Request, commands int) error {
+	rule := p.caller(r)
+	if rule == nil {
+		return fmt.Errorf("%w: unknown caller", ErrUnauthorized)
+	}
+	if !rule.take(time.Now(), commands) {
+		return fmt.Errorf("%w: rate limit exceeded", ErrTooManyRequests)
+	}
+	return nil
+}
+
+// caller returns the rule of the API key of r, or of its client certificate
+// if it's verified. It's nil if neither has a rule.
+func (p *PushRules) caller(r *http.Request) *pushRule {
+	header := p.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+	if key := r.Header.Get(header); key != "" {
+		for _, rule := range p.rules {
+			if rule.APIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(rule.APIKey)) == 1 {
+				return rule
+			}
+		}
+		return nil
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	for _, rule := range p.rules {
+		if rule.Subject != "" && (rule.Subject == subject.CommonName || rule.Subject == subject.String()) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// take takes n tokens from the bucket of the rule, it's refilled by Rate per
+// second up to Burst. It reports false, taking none, if the bucket has fewer.
+func (rule *pushRule) take(now time.Time, n int) bool {
+	if rule.Rate == 0 {
+		return true
+	}
+
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+
+	if !rule.last.IsZero() {
+		rule.tokens += now.Sub(rule.last).Seconds() * rule.Rate
+		if rule.tokens > float64(rule.Burst) {
+			rule.tokens = float64(rule.Burst)
+		}
+	}
+	rule.last = now
+
+	if rule.tokens < float64(n) {
+		return false
+	}
+	rule.tokens -= float64(n)
+	return true
+}
+
+// matchAny reports whether name matches any of patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
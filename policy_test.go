@@ -0,0 +1,168 @@
+package wserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_PushRules_Server(t *testing.T) {
+	file := writeTempFile(t, "rules.json", []byte(`{
+		"rules": [
+			{"apiKey": "billing", "users": ["user-*"], "events": ["billing.*"], "rate": 0.1, "burst": 3},
+			{"apiKey": "admin", "users": ["*"], "events": ["*"]},
+			{"apiKey": "news", "users": ["*"], "events": ["news"], "rate": 0.1, "burst": 2}
+		]
+	}`))
+	rules, err := NewPushRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("")
+	s.PushAuth = rules.PushAuth
+	s.PushPolicy = rules.PushPolicy
+	s.PushLimit = rules.PushLimit
+	s.PushCaller = rules.PushCaller
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	// the request is a GET without msg
+	post := func(path string, msg interface{}, key string) (int, ErrorResponse) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if msg != nil {
+			b, _ := json.Marshal(msg)
+			req, _ = http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(b))
+		}
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var er ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&er)
+		return resp.StatusCode, er
+	}
+
+	cases := []struct {
+		path    string
+		msg     interface{}
+		key     string
+		status  int
+		message string
+	}{
+		{s.PushPath, CommMessage{UserID: "user-1", Event: "billing.paid", CommID: "1", Message: jsonString("hi")}, "nobody", http.StatusUnauthorized, "unauthorized"},
+		// allowed, but nobody receives it
+		{s.PushPath, CommMessage{UserID: "user-1", Event: "billing.paid", CommID: "2", Message: jsonString("hi")}, "billing", http.StatusNotFound, ""},
+		{s.PushPath, CommMessage{UserID: "admin-1", Event: "billing.paid", CommID: "3", Message: jsonString("hi")}, "billing", http.StatusForbidden, `forbidden: push to user "admin-1" not allowed`},
+		{s.PushPath, CommMessage{UserID: "user-1", Event: "chat", CommID: "4", Message: jsonString("hi")}, "billing", http.StatusForbidden, `forbidden: push to event "chat" not allowed`},
+		{s.PushPath, CommMessage{UserID: "user-1", CommID: "5", Message: jsonString("hi")}, "billing", http.StatusForbidden, "forbidden: push without event not allowed"},
+		{s.PushPath, CommMessage{Event: "billing.paid", CommID: "6", Message: jsonString("hi")}, "billing", http.StatusForbidden, "forbidden: push to every user not allowed"},
+		{s.BroadcastPath, BroadcastMessage{UserIDs: []string{"user-1", "admin-1"}, Event: "billing.paid", CommID: "7", Message: jsonString("hi")}, "billing", http.StatusForbidden, `forbidden: push to user "admin-1" not allowed`},
+		{s.BroadcastPath, BroadcastMessage{All: true, Event: "billing.paid", CommID: "8", Message: jsonString("hi")}, "billing", http.StatusForbidden, "forbidden: push to every user not allowed"},
+		{s.BroadcastPath, BroadcastMessage{All: true, CommID: "9", Message: jsonString("hi")}, "admin", http.StatusOK, ""},
+		// the burst is used up by the commands allowed, the ones denied
+		// take nothing, then a multicast takes one for each user at once
+		{s.BroadcastPath, BroadcastMessage{UserIDs: []string{"user-1", "user-2", "user-3"}, Event: "billing.paid", CommID: "10", Message: jsonString("hi")}, "billing", http.StatusTooManyRequests, "too many requests: rate limit exceeded"},
+		{s.BroadcastPath, BroadcastMessage{UserIDs: []string{"user-1", "user-2"}, Event: "billing.paid", CommID: "10", Message: jsonString("hi")}, "billing", http.StatusOK, ""},
+		{s.PushPath, CommMessage{UserID: "user-2", Event: "billing.paid", CommID: "11", Message: jsonString("hi")}, "billing", http.StatusTooManyRequests, "too many requests: rate limit exceeded"},
+		// drop and lookup are not limited, but to the users allowed
+		{s.DropPath, DropMessage{UserID: "user-1", Event: "billing.paid"}, "billing", http.StatusOK, ""},
+		{s.LookupPath + "?userid=user-1", nil, "billing", http.StatusNotFound, ""},
+		{s.DropPath, DropMessage{UserID: "admin-1", Event: "billing.paid"}, "billing", http.StatusForbidden, `forbidden: push to user "admin-1" not allowed`},
+		{s.LookupPath + "?userid=admin-1", nil, "billing", http.StatusForbidden, `forbidden: push to user "admin-1" not allowed`},
+		{s.LookupPath, LookupMessage{UserIDs: []string{"admin-1", "user-1"}}, "billing", http.StatusForbidden, `forbidden: push to user "admin-1" not allowed`},
+		{s.LookupPath + "?userid=user-1", nil, "admin", http.StatusNotFound, ""},
+		{s.LookupPath, nil, "billing", http.StatusForbidden, "forbidden: push to every user not allowed"},
+		{s.DropPath, DropMessage{UserID: "user-1", Event: "chat"}, "billing", http.StatusForbidden, `forbidden: push to event "chat" not allowed`},
+		{s.LookupPath, nil, "admin", http.StatusOK, ""},
+	}
+	for i, tc := range cases {
+		status, er := post(tc.path, tc.msg, tc.key)
+		if status != tc.status || (tc.message != "" && er.Message != tc.message) {
+			t.Fatalf("case %d: %d %+v", i, status, er)
+		}
+	}
+
+	// a push to the subscribers of an event takes one for each of them
+	for i := 0; i < 3; i++ {
+		c := dialAndRegister(t, s, ts, fmt.Sprintf("reader-%d", i), "news")
+		defer c.Close()
+	}
+	if status, _ := post(s.PushPath, CommMessage{Event: "news", CommID: "20", Message: jsonString("hi")}, "news"); status != http.StatusTooManyRequests {
+		t.Fatalf("push to 3 subscribers beyond the burst: %d", status)
+	}
+	if status, _ := post(s.BroadcastPath, BroadcastMessage{UserIDs: []string{"nobody-1", "nobody-2"}, Event: "news", CommID: "21", Message: jsonString("hi")}, "news"); status != http.StatusOK {
+		t.Fatalf("multicast within the burst: %d", status)
+	}
+
+	// async results are served to the caller pushing them only
+	c := dialAndRegister(t, s, ts, "user-3", "")
+	defer c.Close()
+	if status, _ := post(s.PushPath, CommMessage{UserID: "user-3", CommID: "12", Message: jsonString("hi"), Async: true}, "admin"); status != http.StatusAccepted {
+		t.Fatalf("async push: %d", status)
+	}
+	if status, _ := post(s.PushPath+"/12", nil, "billing"); status != http.StatusNotFound {
+		t.Fatalf("result of another caller: %d", status)
+	}
+	if status, _ := post(s.PushPath+"/12", nil, "admin"); status != http.StatusOK {
+		t.Fatalf("result of the caller: %d", status)
+	}
+}
+
+func Test_PushRules_Subject(t *testing.T) {
+	file := writeTempFile(t, "rules.json", []byte(`{
+		"rules": [{"subject": "reports", "users": ["*"], "events": ["report"], "rate": 2}]
+	}`))
+	rules, err := NewPushRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/push", nil)
+	msg := &CommMessage{UserID: "alice", Event: "report"}
+	if err := rules.PushPolicy(r, msg); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("no certificate: %v", err)
+	}
+
+	// the certificate is only trusted if it's verified
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "reports", Organization: []string{"Example"}}}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if rules.PushAuth(r) {
+		t.Fatal("unverified certificate authorized")
+	}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	if !rules.PushAuth(r) {
+		t.Fatal("verified certificate not authorized")
+	}
+
+	now := time.Now()
+	rule := rules.rules[0]
+	if rule.take(now, 3) || !rule.take(now, 1) || !rule.take(now, 1) || rule.take(now, 1) {
+		t.Fatal("burst not limited to the rate")
+	}
+	if !rule.take(now.Add(time.Second), 2) || rule.take(now.Add(time.Second), 1) {
+		t.Fatal("bucket not refilled by the rate")
+	}
+
+	for _, conf := range []string{
+		`{"rules": [{"users": ["*"], "events": ["*"]}]}`,
+		`{"rules": [{"apiKey": "k", "subject": "s"}]}`,
+		`{"rules": [{"apiKey": "k", "events": ["[a"]}]}`,
+		`{"rules": [{"apiKey": "k", "rate": -1}]}`,
+	} {
+		if _, err := NewPushRules(writeTempFile(t, "rules.json", []byte(conf))); err == nil {
+			t.Fatalf("%s loaded", conf)
+		}
+	}
+}
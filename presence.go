@@ -0,0 +1,281 @@
+package wserver
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAlreadyRegistered describes error when a user can't register one more
+// connection because of Server.MaxConnsPerUser.
+var ErrAlreadyRegistered = errors.New("already registered")
+
+// PresenceEntry is a connection of a user recorded in a PresenceStore.
+type PresenceEntry struct {
+	Node    string    `json:"node"`
+	ConnID  string    `json:"connId"`
+	Expires time.Time `json:"expires"`
+}
+
+// PresenceStore records which node each connection of a user is on, so that
+// nodes of a cluster share presence. Every record is a lease which expires
+// unless renewed, so the connections of a dead node are cleaned up.
+type PresenceStore interface {
+	// Register records the connection connID of userID on node for ttl. If
+	// max is greater than 0 and the user already has max live connections,
+	// it fails with ErrAlreadyRegistered.
+	Register(userID, node, connID string, max int, ttl time.Duration) error
+
+	// Renew extends the lease of the connection for ttl, recording it again
+	// if it has expired.
+	Renew(userID, node, connID string, ttl time.Duration) error
+
+	// Unregister removes the connection.
+	Unregister(userID, node, connID string) error
+
+	// Lookup returns the live connections of userID.
+	Lookup(userID string) ([]PresenceEntry, error)
+}
+
+// MemoryPresence is a PresenceStore in memory. It's the default one of
+// Server, and can be shared by servers in the same process.
+type MemoryPresence struct {
+	mu    sync.Mutex
+	users map[string]map[presenceMember]time.Time
+}
+
+type presenceMember struct {
+	node   string
+	connID string
+}
+
+// NewMemoryPresence creates a new MemoryPresence.
+func NewMemoryPresence() *MemoryPresence {
+	return &MemoryPresence{
+		users: make(map[string]map[presenceMember]time.Time),
+	}
+}
+
+// Register implements PresenceStore.
+func (p *MemoryPresence) Register(userID, node, connID string, max int, ttl time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members := p.live(userID)
+	if members == nil {
+		members = make(map[presenceMember]time.Time)
+		p.users[userID] = members
+	}
+	if max > 0 && len(members) >= max {
+		return ErrAlreadyRegistered
+	}
+	members[presenceMember{node, connID}] = time.Now().Add(ttl)
+
+	return nil
+}
+
+// Renew implements PresenceStore.
+func (p *MemoryPresence) Renew(userID, node, connID string, ttl time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members := p.live(userID)
+	if members == nil {
+		members = make(map[presenceMember]time.Time)
+		p.users[userID] = members
+	}
+	members[presenceMember{node, connID}] = time.Now().Add(ttl)
+
+	return nil
+}
+
+// Unregister implements PresenceStore.
+func (p *MemoryPresence) Unregister(userID, node, connID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if members, ok := p.users[userID]; ok {
+		delete(members, presenceMember{node, connID})
+		if len(members) == 0 {
+			delete(p.users, userID)
+		}
+	}
+	return nil
+}
+
+// Lookup implements PresenceStore.
+func (p *MemoryPresence) Lookup(userID string) ([]PresenceEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var entries []PresenceEntry
+	for m, exp := range p.live(userID) {
+		entries = append(entries, PresenceEntry{
+			Node:    m.node,
+			ConnID:  m.connID,
+			Expires: exp,
+		})
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// live removes expired leases of userID and returns the rest. It must be
+// called with p.mu held.
+func (p *MemoryPresence) live(userID string) map[presenceMember]time.Time {
+	members, ok := p.users[userID]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	for m, exp := range members {
+		if !exp.After(now) {
+			delete(members, m)
+		}
+	}
+	if len(members) == 0 {
+		delete(p.users, userID)
+		return nil
+	}
+	return members
+}
+
+// RedisPresence is a PresenceStore in Redis, or any server speaking the Redis
+// protocol. Connections of a user are kept in the sorted set
+// Prefix + "presence:" + userID, scored by the expiry of their lease.
+type RedisPresence struct {
+	// Addr of the Redis server, like "127.0.0.1:6379".
+	Addr string
+
+	// Password for AUTH, empty if not required.
+	Password string
+
+	// Prefix of keys, default "wserver:".
+	Prefix string
+
+	// DialTimeout for connecting to the Redis server, default 5s.
+	DialTimeout time.Duration
+
+	client respClient
+}
+
+// NewRedisPresence creates a new RedisPresence connecting to addr.
+func NewRedisPresence(addr string) *RedisPresence {
+	return &RedisPresence{
+		Addr:        addr,
+		Prefix:      redisDefaultPrefix,
+		DialTimeout: redisDefaultDialTimeout,
+	}
+}
+
+// Register implements PresenceStore. The connection is added before the
+// number of connections is checked, and removed again if it exceeds max, so
+// concurrent registrations never exceed max.
+func (p *RedisPresence) Register(userID, node, connID string, max int, ttl time.Duration) error {
+	key, member := p.key(userID), node+"\n"+connID
+
+	now := time.Now()
+	if _, err := p.do("ZREMRANGEBYSCORE", key, "-inf", msString(now)); err != nil {
+		return err
+	}
+	if err := p.add(key, member, now.Add(ttl), ttl); err != nil {
+		return err
+	}
+	if max <= 0 {
+		return nil
+	}
+
+	n, err := p.do("ZCARD", key)
+	if err != nil {
+		return err
+	}
+	if count, _ := n.(int64); count > int64(max) {
+		p.do("ZREM", key, member)
+		return ErrAlreadyRegistered
+	}
+	return nil
+}
+
+// Renew implements PresenceStore.
+func (p *RedisPresence) Renew(userID, node, connID string, ttl time.Duration) error {
+	return p.add(p.key(userID), node+"\n"+connID, time.Now().Add(ttl), ttl)
+}
+
+// Unregister implements PresenceStore.
+func (p *RedisPresence) Unregister(userID, node, connID string) error {
+	_, err := p.do("ZREM", p.key(userID), node+"\n"+connID)
+	return err
+}
+
+// Lookup implements PresenceStore.
+func (p *RedisPresence) Lookup(userID string) ([]PresenceEntry, error) {
+	reply, err := p.do("ZRANGEBYSCORE", p.key(userID), "("+msString(time.Now()), "+inf", "WITHSCORES")
+	if err != nil {
+		return nil, err
+	}
+
+	arr, _ := reply.([]interface{})
+	var entries []PresenceEntry
+	for i := 0; i+1 < len(arr); i += 2 {
+		member, _ := arr[i].([]byte)
+		score, _ := arr[i+1].([]byte)
+
+		parts := strings.SplitN(string(member), "\n", 2)
+		ms, err := strconv.ParseFloat(string(score), 64)
+		if len(parts) != 2 || err != nil {
+			continue
+		}
+		entries = append(entries, PresenceEntry{
+			Node:    parts[0],
+			ConnID:  parts[1],
+			Expires: time.Unix(0, int64(ms)*int64(time.Millisecond)),
+		})
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// add records member in key until expires, and keeps key for ttl so users
+// without live connections vanish.
+func (p *RedisPresence) add(key, member string, expires time.Time, ttl time.Duration) error {
+	if _, err := p.do("ZADD", key, msString(expires), member); err != nil {
+		return err
+	}
+	_, err := p.do("PEXPIRE", key, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+func (p *RedisPresence) do(args ...string) (interface{}, error) {
+	return p.client.do(func() (*respConn, error) {
+		timeout := p.DialTimeout
+		if timeout <= 0 {
+			timeout = redisDefaultDialTimeout
+		}
+		return dialRESP(p.Addr, p.Password, timeout)
+	}, args...)
+}
+
+func (p *RedisPresence) key(userID string) string {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = redisDefaultPrefix
+	}
+	return prefix + "presence:" + userID
+}
+
+// msString formats t as unix time in milliseconds.
+func msString(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// sortEntries sorts entries by expiry, so the connection renewed most
+// recently is the last.
+func sortEntries(entries []PresenceEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Expires.Before(entries[j].Expires)
+	})
+}
@@ -0,0 +1,264 @@
+package wserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtoCodec encodes messages in the Protocol Buffers wire format in binary
+// frames, as described by wserver.proto:
+//
+//	message CommRequest {
+//	  string id = 1;
+//	  bytes msg = 2; // JSON
+//	  int64 timeout = 3;
+//	  int64 deadline = 4;
+//	  bytes data = 5;
+//	  bool no_reply = 6;
+//	  Reply reply = 7;
+//	  RegisterResult register = 8;
+//	  AuthStatus auth = 9;
+//	}
+//
+//	message Reply {
+//	  string id = 1;
+//	  bytes result = 2; // JSON
+//	  string status = 3;
+//	  string code = 4;
+//	  string error = 5;
+//	}
+//
+//	message RegisterResult {
+//	  string user_id = 1;
+//	  string status = 2;
+//	  string code = 3;
+//	  string error = 4;
+//	}
+//
+//	message AuthStatus {
+//	  string status = 1;
+//	  int64 expires = 2;
+//	  string code = 3;
+//	  string error = 4;
+//	}
+//
+//	message CommResponse {
+//	  string id = 1;
+//	  bytes msg = 2; // JSON
+//	  string status = 3;
+//	  string code = 4;
+//	  string error = 5;
+//	  bytes data = 6;
+//	}
+//
+//	message WSMessage {
+//	  int32 kind = 1;
+//	  bytes body = 2; // JSON
+//	  CommResponse response = 3; // instead of body for kind 255
+//	}
+type ProtoCodec struct{}
+
+// Name implements Codec.
+func (ProtoCodec) Name() string {
+	return "wserver.proto"
+}
+
+// MessageType implements Codec.
+func (ProtoCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+// Marshal implements Codec.
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	var p []byte
+
+	switch v := v.(type) {
+	case *CommRequest:
+		p = appendProtoBytes(p, 1, []byte(v.Id))
+		p = appendProtoBytes(p, 2, v.Msg)
+		p = appendProtoVarint(p, 3, uint64(v.Timeout))
+		p = appendProtoVarint(p, 4, uint64(v.Deadline))
+		p = appendProtoBytes(p, 5, v.Data)
+		if v.NoReply {
+			p = appendProtoVarint(p, 6, 1)
+		}
+		if r := v.Reply; r != nil {
+			var b []byte
+			b = appendProtoBytes(b, 1, []byte(r.Id))
+			b = appendProtoBytes(b, 2, r.Result)
+			b = appendProtoBytes(b, 3, []byte(r.Status))
+			b = appendProtoBytes(b, 4, []byte(r.Code))
+			b = appendProtoBytes(b, 5, []byte(r.Error))
+			p = appendProtoField(p, 7, b)
+		}
+		if r := v.Register; r != nil {
+			var b []byte
+			b = appendProtoBytes(b, 1, []byte(r.UserID))
+			b = appendProtoBytes(b, 2, []byte(r.Status))
+			b = appendProtoBytes(b, 3, []byte(r.Code))
+			b = appendProtoBytes(b, 4, []byte(r.Error))
+			p = appendProtoField(p, 8, b)
+		}
+		if a := v.Auth; a != nil {
+			var b []byte
+			b = appendProtoBytes(b, 1, []byte(a.Status))
+			b = appendProtoVarint(b, 2, uint64(a.Expires))
+			b = appendProtoBytes(b, 3, []byte(a.Code))
+			b = appendProtoBytes(b, 4, []byte(a.Error))
+			p = appendProtoField(p, 9, b)
+		}
+	case *WSMessage:
+		p = appendProtoVarint(p, 1, uint64(v.Kind))
+		p = appendProtoBytes(p, 2, v.Body)
+	default:
+		return nil, fmt.Errorf("proto: unsupported type %T", v)
+	}
+
+	return p, nil
+}
+
+// Unmarshal implements Codec. A response is converted to the JSON body of
+// wm.
+func (ProtoCodec) Unmarshal(data []byte, wm *WSMessage) error {
+	*wm = WSMessage{}
+
+	return readProto(data, func(num int, varint uint64, b []byte) error {
+		switch num {
+		case 1:
+			wm.Kind = int(int32(varint))
+		case 2:
+			wm.Body = append(json.RawMessage(nil), b...)
+		case 3:
+			var cr CommResponse
+			if err := unmarshalProtoResponse(b, &cr); err != nil {
+				return err
+			}
+			raw, err := json.Marshal(&cr)
+			if err != nil {
+				return err
+			}
+			wm.Body = raw
+		}
+		return nil
+	})
+}
+
+func unmarshalProtoResponse(data []byte, cr *CommResponse) error {
+	return readProto(data, func(num int, varint uint64, b []byte) error {
+		switch num {
+		case 1:
+			cr.Id = string(b)
+		case 2:
+			if len(b) > 0 {
+				cr.Msg = append(json.RawMessage(nil), b...)
+			}
+		case 3:
+			cr.Status = string(b)
+		case 4:
+			cr.Code = string(b)
+		case 5:
+			cr.Error = string(b)
+		case 6:
+			cr.Data = append([]byte(nil), b...)
+		}
+		return nil
+	})
+}
+
+// Wire types of Protocol Buffers.
+const (
+	protoVarint = 0
+	protoI64    = 1
+	protoLen    = 2
+	protoI32    = 5
+)
+
+// appendProtoVarint appends the varint field num, it's omitted if zero.
+func appendProtoVarint(p []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return p
+	}
+	p = appendUvarint(p, uint64(num)<<3|protoVarint)
+	return appendUvarint(p, v)
+}
+
+// appendProtoBytes appends the length-delimited field num, it's omitted if
+// empty.
+func appendProtoBytes(p []byte, num int, b []byte) []byte {
+	if len(b) == 0 {
+		return p
+	}
+	p = appendUvarint(p, uint64(num)<<3|protoLen)
+	p = appendUvarint(p, uint64(len(b)))
+	return append(p, b...)
+}
+
+// appendProtoField appends the embedded message field num, it's written even
+// if empty.
+func appendProtoField(p []byte, num int, b []byte) []byte {
+	p = appendUvarint(p, uint64(num)<<3|protoLen)
+	p = appendUvarint(p, uint64(len(b)))
+	return append(p, b...)
+}
+
+func appendUvarint(p []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(p, buf[:n]...)
+}
+
+// readProto calls fn with each field of the message in data, with its value
+// in varint for varint fields or in b for length-delimited ones. Fields of
+// other wire types are skipped.
+func readProto(data []byte, fn func(num int, varint uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("proto: malformed field key")
+		}
+		data = data[n:]
+
+		num := int(key >> 3)
+		var varint uint64
+		var b []byte
+
+		switch key & 7 {
+		case protoVarint:
+			varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("proto: malformed varint")
+			}
+			data = data[n:]
+		case protoLen:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errors.New("proto: malformed length")
+			}
+			b = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case protoI64:
+			if len(data) < 8 {
+				return errors.New("proto: unexpected end of data")
+			}
+			data = data[8:]
+			continue
+		case protoI32:
+			if len(data) < 4 {
+				return errors.New("proto: unexpected end of data")
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", key&7)
+		}
+
+		if err := fn(num, varint, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package wserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDefaultPrefix      = "wserver:"
+	redisDefaultDialTimeout = 5 * time.Second
+	redisReconnectWait      = time.Second
+)
+
+// respError is an error reply of the Redis protocol.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respConn is a minimal client of the Redis protocol (RESP), enough for the
+// commands used by RedisBroker. It's not safe for concurrent use.
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRESP connects to the Redis compatible server at addr, and authorizes
+// with password if it's not empty.
+func dialRESP(addr, password string, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &respConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// send writes a command as an array of bulk strings.
+func (c *respConn) send(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// receive reads a reply. It's a string for simple strings, int64 for
+// integers, []byte for bulk strings (nil if null), []interface{} for arrays
+// and respError for errors.
+func (c *respConn) receive() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("resp: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return respError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		p := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, p); err != nil {
+			return nil, err
+		}
+		return p[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+
+	return nil, fmt.Errorf("resp: unknown reply type %q", kind)
+}
+
+// do sends a command and receives its reply, an error reply is returned as
+// error.
+func (c *respConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	reply, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(respError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (c *respConn) Close() error {
+	return c.conn.Close()
+}
+
+// respClient keeps one connection for request/response commands, and dials
+// it again when it's broken. It's safe for concurrent use.
+type respClient struct {
+	mu   sync.Mutex
+	conn *respConn
+}
+
+// do runs a command, dialing by dial if there is no connection. A command
+// failed by a broken connection is retried once with a new one.
+func (c *respClient) do(dial func() (*respConn, error), args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for retry := 0; ; retry++ {
+		var err error
+		if c.conn == nil {
+			if c.conn, err = dial(); err != nil {
+				return nil, err
+			}
+		}
+
+		reply, err := c.conn.do(args...)
+		if _, ok := err.(respError); err == nil || ok || retry > 0 {
+			return reply, err
+		}
+
+		// network error, the connection is unusable
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// brokerEnvelope is the payload published by RedisBroker.
+type brokerEnvelope struct {
+	Command  *BrokerCommand  `json:"command,omitempty"`
+	Response *BrokerResponse `json:"response,omitempty"`
+}
+
+// RedisBroker is a Broker using publish/subscribe of Redis, or any server
+// speaking the Redis protocol. The inbox of a node is the channel
+// Prefix + "node:" + node, and commands for every node are published to
+// Prefix + "all".
+type RedisBroker struct {
+	// Addr of the Redis server, like "127.0.0.1:6379".
+	Addr string
+
+	// Password for AUTH, empty if not required.
+	Password string
+
+	// Prefix of channel names, default "wserver:".
+	Prefix string
+
+	// DialTimeout for connecting to the Redis server, default 5s.
+	DialTimeout time.Duration
+
+	pub respClient
+}
+
+// NewRedisBroker creates a new RedisBroker connecting to addr.
+func NewRedisBroker(addr string) *RedisBroker {
+	return &RedisBroker{
+		Addr:        addr,
+		Prefix:      redisDefaultPrefix,
+		DialTimeout: redisDefaultDialTimeout,
+	}
+}
+
+// PublishCommand implements Broker.
+func (b *RedisBroker) PublishCommand(node string, cmd *BrokerCommand) error {
+	channel := b.prefix() + "all"
+	if node != "" {
+		channel = b.nodeChannel(node)
+	}
+	return b.publish(channel, &brokerEnvelope{Command: cmd})
+}
+
+// PublishResponse implements Broker.
+func (b *RedisBroker) PublishResponse(node string, resp *BrokerResponse) error {
+	return b.publish(b.nodeChannel(node), &brokerEnvelope{Response: resp})
+}
+
+// publish sends env to channel through the shared publishing connection.
+func (b *RedisBroker) publish(channel string, env *brokerEnvelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.pub.do(b.dial, "PUBLISH", channel, string(payload))
+	return err
+}
+
+func (b *RedisBroker) dial() (*respConn, error) {
+	return dialRESP(b.Addr, b.Password, b.dialTimeout())
+}
+
+// Subscribe implements Broker. It subscribes with a dedicated connection,
+// which is dialed again if it's broken.
+func (b *RedisBroker) Subscribe(node string, h BrokerHandler) (func(), error) {
+	channels := []string{b.nodeChannel(node), b.prefix() + "all"}
+
+	conn, err := b.subscribe(channels)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			b.receive(conn, h)
+
+			mu.Lock()
+			conn.Close()
+			conn = nil
+			mu.Unlock()
+
+			// reconnect until cancelled
+			for conn == nil {
+				select {
+				case <-stopCh:
+					return
+				case <-time.After(redisReconnectWait):
+				}
+
+				c, err := b.subscribe(channels)
+				if err != nil {
+					log.Println("redis broker:", err)
+					continue
+				}
+				mu.Lock()
+				select {
+				case <-stopCh:
+					// cancelled while subscribing
+					mu.Unlock()
+					c.Close()
+					return
+				default:
+				}
+				conn = c
+				mu.Unlock()
+			}
+		}
+	}()
+
+	cancel := func() {
+		close(stopCh)
+		mu.Lock()
+		if conn != nil {
+			conn.Close()
+		}
+		mu.Unlock()
+		<-done
+	}
+	return cancel, nil
+}
+
+// subscribe dials a connection and subscribes it to channels.
+func (b *RedisBroker) subscribe(channels []string) (*respConn, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.send(append([]string{"SUBSCRIBE"}, channels...)...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// one confirmation for each channel
+	for range channels {
+		reply, err := conn.receive()
+		if err == nil {
+			if e, ok := reply.(respError); ok {
+				err = e
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// receive dispatches messages read from conn to h until conn is broken.
+func (b *RedisBroker) receive(conn *respConn, h BrokerHandler) {
+	for {
+		reply, err := conn.receive()
+		if err != nil {
+			return
+		}
+
+		// ["message", channel, payload]
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 3 {
+			continue
+		}
+		if kind, _ := arr[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		payload, _ := arr[2].([]byte)
+
+		var env brokerEnvelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			continue
+		}
+		if env.Command != nil {
+			h.HandleCommand(env.Command)
+		}
+		if env.Response != nil {
+			h.HandleResponse(env.Response)
+		}
+	}
+}
+
+func (b *RedisBroker) nodeChannel(node string) string {
+	return b.prefix() + "node:" + node
+}
+
+func (b *RedisBroker) prefix() string {
+	if b.Prefix == "" {
+		return redisDefaultPrefix
+	}
+	return b.Prefix
+}
+
+func (b *RedisBroker) dialTimeout() time.Duration {
+	if b.DialTimeout <= 0 {
+		return redisDefaultDialTimeout
+	}
+	return b.DialTimeout
+}
@@ -0,0 +1,142 @@
+package wserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrNoSuchMethod describes error when the client calls a method no handler
+// is registered for.
+var ErrNoSuchMethod = errors.New("no such method")
+
+// Request is sent by the client in a RequestMessageType message to call the
+// handler of Method. The server answers it with a Reply of the same Id.
+type Request struct {
+	Id     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+
+	// UserID is the user the connection is registered for.
+	UserID string `json:"-"`
+
+	// Conn is the connection sending the request.
+	Conn *Conn `json:"-"`
+}
+
+// Reply answers a Request, it's sent to the client in Reply of a
+// CommRequest. Status is CommStatusOK with Result, or CommStatusError with
+// Code and Error.
+type Reply struct {
+	Id     string          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Status string          `json:"status"`
+	Code   string          `json:"code,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// HandlerFunc handles a request of the client and returns the result, which is
+// any JSON value. The context is cancelled when the connection is closed.
+//
+// The error replied has the code of a HandlerError, or the one of a known
+// error like ErrUnauthorized, or CodeInternal.
+type HandlerFunc func(ctx context.Context, req *Request) (json.RawMessage, error)
+
+// Middleware wraps a HandlerFunc, like to log or authorize requests.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// HandlerError is returned by a HandlerFunc to reply the error with Code.
+type HandlerError struct {
+	Code    string
+	Message string
+}
+
+func (e *HandlerError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// router dispatches requests of clients to handlers by method.
+type router struct {
+	mu         sync.RWMutex
+	handlers   map[string]HandlerFunc
+	middleware []Middleware
+}
+
+// handle registers fn for method, it replaces the one registered before.
+func (r *router) handle(method string, fn HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handlers == nil {
+		r.handlers = make(map[string]HandlerFunc)
+	}
+	r.handlers[method] = fn
+}
+
+// use appends mw to the middleware wrapping every handler.
+func (r *router) use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.middleware = append(r.middleware, mw...)
+}
+
+// lookup returns the handler of method wrapped by the middleware, the first
+// middleware is the outermost. Unknown methods get a handler failing with
+// ErrNoSuchMethod, so middleware sees them too.
+func (r *router) lookup(method string) HandlerFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	fn, ok := r.handlers[method]
+	if !ok {
+		fn = func(context.Context, *Request) (json.RawMessage, error) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSuchMethod, method)
+		}
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		fn = r.middleware[i](fn)
+	}
+	return fn
+}
+
+// serve calls the handler of req and returns the reply. A panic of the
+// handler or middleware is replied with CodeInternal.
+func (r *router) serve(ctx context.Context, req *Request) (reply *Reply) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("handle %s: panic: %v\n%s", req.Method, p, debug.Stack())
+			reply = errorReply(req.Id, &HandlerError{Code: CodeInternal, Message: "internal error"})
+		}
+	}()
+
+	result, err := r.lookup(req.Method)(ctx, req)
+	if err != nil {
+		return errorReply(req.Id, err)
+	}
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	return &Reply{Id: req.Id, Result: result, Status: CommStatusOK}
+}
+
+// errorReply returns the reply of request id failed with err.
+func errorReply(id string, err error) *Reply {
+	reply := &Reply{Id: id, Status: CommStatusError, Error: err.Error()}
+
+	var he *HandlerError
+	if errors.As(err, &he) {
+		reply.Code = he.Code
+		reply.Error = he.Message
+	} else {
+		reply.Code = errorCode(err)
+	}
+	return reply
+}
@@ -2,17 +2,40 @@
 package wserver
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 const (
 	serverDefaultWSPath   = "/ws"
 	serverDefaultPushPath = "/push"
+	serverDefaultDropPath = "/drop"
+
+	serverDefaultBroadcastPath = "/broadcast"
+	serverDefaultLookupPath    = "/lookup"
+
+	serverDefaultSendQueueSize  = 256
+	serverDefaultMaxRequests    = 16
+	serverDefaultMaxMessageSize = 1 << 20
+	serverDefaultWriteWait      = 10 * time.Second
+	serverDefaultPongWait       = 60 * time.Second
+
+	serverDefaultRegisterTimeout = 10 * time.Second
+	serverDefaultReauthNotice    = time.Minute
+
+	serverDefaultPushTimeout    = time.Second
+	serverDefaultMaxPushTimeout = time.Minute
 )
 
 var defaultUpgrader = &websocket.Upgrader{
@@ -34,6 +57,119 @@ type Server struct {
 	// Path for push message, default "/push".
 	PushPath string
 
+	// Path for dropping connections of a user, default "/drop". The request
+	// is authorized by PushAuth as well.
+	DropPath string
+
+	// Path for pushing a command to several users, default "/broadcast".
+	// The request is authorized by PushAuth as well.
+	BroadcastPath string
+
+	// Path for looking up connected users and their connections, default
+	// "/lookup". The request is authorized by PushAuth as well.
+	LookupPath string
+
+	// Paths except WSPath can be empty to disable the endpoint.
+
+	// PushTimeout is how long a push waits for the response of the client
+	// when the push message gives no timeout, default 1s.
+	PushTimeout time.Duration
+
+	// MaxPushTimeout bounds the timeout given by push messages, default 1m.
+	// Asynchronous pushes without timeout wait this long.
+	MaxPushTimeout time.Duration
+
+	// MaxConnsPerUser limits how many connections a user can register at the
+	// same time, default 0 means no limit. Set it to 1 to allow only one
+	// session per user.
+	MaxConnsPerUser int
+
+	// SendQueueSize is the number of outbound messages buffered by each
+	// connection, default 256. Messages are written by one goroutine per
+	// connection.
+	SendQueueSize int
+
+	// MaxRequests is the number of requests of a connection served by the
+	// handlers of Handle at once, default 16. Requests beyond are replied
+	// with CodeTooManyRequests.
+	MaxRequests int
+
+	// MaxMessageSize is the size in bytes of a message read from a
+	// connection at most, default 1 MiB. The connection is closed with
+	// websocket.CloseMessageTooBig if a message is larger. Negative means no
+	// limit.
+	MaxMessageSize int64
+
+	// WriteWait is the time allowed to write a message to the peer, default
+	// 10s. The connection is closed if a write takes longer.
+	WriteWait time.Duration
+
+	// QueueFullPolicy decides what to do when the send queue of a connection
+	// is full, default QueueBlock.
+	QueueFullPolicy QueuePolicy
+
+	// PongWait is the time allowed to read the next pong or message from the
+	// peer, default 60s. The peer is considered dead if it's exceeded.
+	PongWait time.Duration
+
+	// PingInterval is the period to send ping to the peer, default 9/10 of
+	// PongWait. It must be less than PongWait.
+	PingInterval time.Duration
+
+	// OnDeadPeer is called after a connection missing the heartbeat is
+	// closed and unbound. The reason is ErrPongTimeout or ErrPingFailed.
+	OnDeadPeer func(conn *Conn, reason error)
+
+	// RegisterTimeout is the time allowed to a connection to send the
+	// register message, default 10s. The connection is closed with
+	// websocket.ClosePolicyViolation if it doesn't register in time. Negative
+	// means no limit.
+	RegisterTimeout time.Duration
+
+	// ReauthNotice is the time before the token of a connection expires when
+	// ProtocolVersion2 clients are told to reauthenticate, default 1 minute.
+	ReauthNotice time.Duration
+
+	// OnConnect is called when a connection is upgraded from r, before any
+	// message is read from it.
+	OnConnect func(conn *Conn, r *http.Request)
+
+	// OnRegister is called after a connection sends the register message.
+	// The err is nil if it's bound to userID, which is empty if the token is
+	// rejected.
+	OnRegister func(conn *Conn, userID string, err error)
+
+	// OnMessage is called with every message read from a connection, before
+	// it's handled. It must not modify data.
+	OnMessage func(conn *Conn, messageType int, data []byte)
+
+	// OnClose is called after a connection is closed and unbound, with the
+	// close code and reason sent by either side. The code is
+	// websocket.CloseAbnormalClosure if the connection is lost or the peer
+	// misses the heartbeat.
+	OnClose func(conn *Conn, code int, reason string)
+
+	// Broker relays commands between the nodes of a cluster. If it's not
+	// nil, pushes for users not connected to this node are routed to the
+	// node they are connected to. Presence must be shared by the nodes
+	// then. Default nil and the server runs alone.
+	Broker Broker
+
+	// NodeID identifies this node in the cluster, default a random UUID.
+	NodeID string
+
+	// Presence records the connections of users with the node they are
+	// bound on. Nodes sharing it enforce MaxConnsPerUser across the
+	// cluster, and pushes are routed straight to the node of the user.
+	// It's required with Broker, so pushes to users connected nowhere fail
+	// at once. Default nil and a private MemoryPresence is used.
+	Presence PresenceStore
+
+	// PresenceTTL is the lease of a connection in Presence, default twice
+	// PongWait. Leases are renewed by the heartbeat, so connections of a
+	// dead node expire after it.
+	PresenceTTL time.Duration
+
 	// Upgrader is for upgrade connection to websocket connection using
 	// "github.com/gorilla/websocket".
 	//
@@ -42,74 +178,550 @@ type Server struct {
 	// returns true.
 	Upgrader *websocket.Upgrader
 
+	// Codecs encode messages exchanged with clients, which choose one by the
+	// websocket subprotocol of its name. Clients choosing none use the first
+	// one. Default JSONCodec, MsgPackCodec and ProtoCodec. Their names are
+	// added to the subprotocols of Upgrader.
+	Codecs []Codec
+
 	// Check token if it's valid and return userID. If token is valid, userID
 	// must be returned and ok should be true. Otherwise ok should be false.
 	AuthToken func(token string) (userID string, ok bool)
 
+	// VerifyToken checks the token of the register message like AuthToken,
+	// which is ignored if VerifyToken is set. It returns the claims of the
+	// user as well, see Conn.Claims. JWTAuth.VerifyToken is one.
+	VerifyToken func(token string) (userID string, claims map[string]interface{}, err error)
+
+	// AuthRequest authenticates the websocket upgrade request, like by a
+	// header, query parameter or cookie, before it's upgraded. If it fails
+	// with an error matching ErrForbidden, the request is rejected with 403,
+	// otherwise with 401. If userID is not empty, the connection is
+	// registered for it at once, a register message then only subscribes its
+	// event. Such connections give the protocol version by the query
+	// parameter "version". The claims are kept by the connection, see
+	// Conn.Claims. Such connections reauthenticate with tokens verified by
+	// VerifyToken, and can't without it.
+	//
+	// If the claims given by VerifyToken or AuthRequest have "exp", the
+	// connection is closed with websocket.ClosePolicyViolation when it
+	// passes.
+	AuthRequest func(r *http.Request) (userID string, claims map[string]interface{}, err error)
+
 	// Authorize push request. Message will be sent if it returns true,
 	// otherwise the request will be discarded. Default nil and push request
 	// will always be accepted.
 	PushAuth func(r *http.Request) bool
 
+	// PushCaller identifies the caller of push requests, the result of an
+	// asynchronous push is only served to the caller pushing it. Default
+	// nil identifies callers by the Authorization header.
+	PushCaller func(r *http.Request) string
+
+	// CallbackHosts are the hosts results of asynchronous pushes may be
+	// posted to, like "backend" or "*.example.com:8080". They're patterns of
+	// path.Match against the host and port of the callback URL. Push
+	// requests with other callbacks are rejected with ErrForbidden, so
+	// callbacks are refused if it's empty.
+	CallbackHosts []string
+
+	// PushPolicy authorizes the commands of push requests accepted by
+	// PushAuth, like to allow a caller to push to some events only. It's
+	// given the request and the decoded message, whose UserID is empty if
+	// the command is pushed to every subscriber of Event. Broadcast requests
+	// are checked for each user, or without UserID if they push to all.
+	// Drop and lookup requests are checked as well, with a message without
+	// command of the users they target, or without UserID if they list all
+	// users. If it fails with an error matching ErrUnauthorized or
+	// ErrTooManyRequests, the request is rejected with 401 or 429, otherwise
+	// with 403 and the error as reason. See PushRules.
+	PushPolicy func(r *http.Request, msg *CommMessage) error
+
+	// PushLimit charges the commands of a push request once PushPolicy
+	// allows all of them, like to limit their rate by caller. commands is the
+	// number of users pushed to, a push to every subscriber of an event
+	// counts the subscribers of this node. Drop and lookup requests are not
+	// charged. It fails like PushPolicy, usually with ErrTooManyRequests.
+	PushLimit func(r *http.Request, commands int) error
+
+	// TLSConfig is used by ListenAndServeTLS if it's not nil, like to verify
+	// client certificates of push requests.
+	TLSConfig *tls.Config
+
+	router router
+
 	wh *websocketHandler
 	ph *pushHandler
+	dh *dropHandler
+	bh *broadcastHandler
+	lh *lookupHandler
+
+	// mux routes to the handlers above, it's created once by setup
+	mux http.Handler
+
+	// mu guards the handlers and httpServer, which are created when the
+	// server starts.
+	mu         sync.Mutex
+	httpServer *http.Server
 }
 
 // ListenAndServe listens on the TCP network address and handle websocket
-// request.
+// request. After Shutdown, it returns http.ErrServerClosed.
 func (s *Server) ListenAndServe() error {
+	return s.serve(func(srv *http.Server) error {
+		return srv.ListenAndServe()
+	})
+}
+
+// ListenAndServeTLS is like ListenAndServe, but serves HTTPS and WSS with the
+// certificate and key files.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	return s.serve(func(srv *http.Server) error {
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	})
+}
+
+// Serve accepts connections on the listener l and handle websocket request.
+// The Addr is ignored.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(func(srv *http.Server) error {
+		return srv.Serve(l)
+	})
+}
+
+// Handler returns the http.Handler routing WSPath, PushPath and the other
+// paths of Server, so it can be mounted into an existing router, behind TLS
+// termination or under a path prefix (with http.StripPrefix). It returns
+// error if the parameters of Server are illegal. Handlers are created once,
+// later calls return the same one.
+func (s *Server) Handler() (http.Handler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.setup()
+}
+
+// serve creates a http.Server for Server and runs it by fn.
+func (s *Server) serve(fn func(srv *http.Server) error) error {
+	s.mu.Lock()
+	h, err := s.setup()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.httpServer = &http.Server{
+		Addr:      s.Addr,
+		Handler:   h,
+		TLSConfig: s.TLSConfig,
+	}
+	srv := s.httpServer
+	s.mu.Unlock()
+
+	return fn(srv)
+}
+
+// setup checks parameters and creates the handlers once. It must be called
+// with s.mu held.
+func (s *Server) setup() (http.Handler, error) {
+	if s.mux != nil {
+		return s.mux, nil
+	}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+
+	if s.NodeID == "" {
+		s.NodeID = uuid.New().String()
+	}
+	s.init()
+	if s.Broker != nil {
+		c, err := newCluster(s.NodeID, s.Broker, s.ph, s.Presence)
+		if err != nil {
+			return nil, err
+		}
+		s.ph.cluster = c
+	}
+
+	s.mux = s.handler()
+	return s.mux, nil
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting websocket
+// connections, closes the current ones with a going away close frame and
+// fails the commands waiting for their response with ErrShuttingDown. Then
+// it waits for the pending push requests and connections to finish, or ctx
+// to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	wh, ph, srv := s.wh, s.ph, s.httpServer
+	s.mu.Unlock()
+
+	if wh == nil {
+		return nil
+	}
+
+	wh.shutdown()
+	if c := ph.cluster; c != nil {
+		c.close(ErrShuttingDown)
+	}
+
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wh.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// handler routes requests to the handlers of Server.
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(s.WSPath, s.wh)
+	if s.PushPath != "" {
+		mux.Handle(s.PushPath, s.ph)
+		if !strings.HasSuffix(s.PushPath, "/") {
+			mux.Handle(s.PushPath+"/", s.ph)
+		}
+	}
+	if s.DropPath != "" {
+		mux.Handle(s.DropPath, s.dh)
+	}
+	if s.BroadcastPath != "" {
+		mux.Handle(s.BroadcastPath, s.bh)
+	}
+	if s.LookupPath != "" {
+		mux.Handle(s.LookupPath, s.lh)
+	}
+	return mux
+}
+
+// init creates the handlers of Server.
+func (s *Server) init() {
 	cm := &CommManager{
 		userConnCommMap: make(map[string]*CommConn),
+		eventConnMap:    make(map[string]map[*Conn]struct{}),
+		maxConns:        s.MaxConnsPerUser,
+		registry:        s.Presence,
+		node:            s.NodeID,
+	}
+	if cm.registry == nil {
+		cm.registry = NewMemoryPresence()
 	}
 
 	// websocket request handler
 	wh := websocketHandler{
-		upgrader: defaultUpgrader,
-		cm:       cm,
+		upgrader:      defaultUpgrader,
+		cm:            cm,
+		router:        &s.router,
+		conns:         make(map[*Conn]struct{}),
+		sendQueueSize: serverDefaultSendQueueSize,
+		writeWait:     serverDefaultWriteWait,
+		queuePolicy:   s.QueueFullPolicy,
+		maxRequests:   serverDefaultMaxRequests,
+	}
+	wh.maxMessageSize = serverDefaultMaxMessageSize
+	if s.MaxMessageSize != 0 {
+		wh.maxMessageSize = s.MaxMessageSize
+	}
+	if s.SendQueueSize > 0 {
+		wh.sendQueueSize = s.SendQueueSize
+	}
+	if s.MaxRequests > 0 {
+		wh.maxRequests = s.MaxRequests
+	}
+	if s.WriteWait > 0 {
+		wh.writeWait = s.WriteWait
+	}
+	wh.pongWait = serverDefaultPongWait
+	if s.PongWait > 0 {
+		wh.pongWait = s.PongWait
+	}
+	cm.leaseTTL = wh.pongWait * 2
+	if s.PresenceTTL > 0 {
+		cm.leaseTTL = s.PresenceTTL
+	}
+	wh.pingInterval = wh.pongWait * 9 / 10
+	if s.PingInterval > 0 && s.PingInterval < wh.pongWait {
+		wh.pingInterval = s.PingInterval
+	}
+	wh.onDeadPeer = s.OnDeadPeer
+	wh.onConnect = s.OnConnect
+	wh.onRegister = s.OnRegister
+	wh.onMessage = s.OnMessage
+	wh.onClose = s.OnClose
+	wh.reauthNotice = serverDefaultReauthNotice
+	if s.ReauthNotice > 0 {
+		wh.reauthNotice = s.ReauthNotice
+	}
+	wh.registerTimeout = serverDefaultRegisterTimeout
+	if s.RegisterTimeout != 0 {
+		wh.registerTimeout = s.RegisterTimeout
 	}
 	if s.Upgrader != nil {
 		wh.upgrader = s.Upgrader
 	}
+	wh.codecs = s.Codecs
+	if len(wh.codecs) == 0 {
+		wh.codecs = defaultCodecs()
+	}
+	wh.upgrader = withSubprotocols(wh.upgrader, wh.codecs)
 	if s.AuthToken != nil {
 		wh.calcUserIDFunc = s.AuthToken
 	}
+	wh.verifyToken = s.VerifyToken
+	wh.authRequest = s.AuthRequest
 	s.wh = &wh
-	http.Handle(s.WSPath, s.wh)
 
 	// push request handler
 	ph := pushHandler{
-		cm: cm,
+		cm:         cm,
+		path:       s.PushPath,
+		results:    newAsyncStore(),
+		timeout:    serverDefaultPushTimeout,
+		maxTimeout: serverDefaultMaxPushTimeout,
+	}
+	if s.PushTimeout > 0 {
+		ph.timeout = s.PushTimeout
+	}
+	if s.MaxPushTimeout > 0 {
+		ph.maxTimeout = s.MaxPushTimeout
+	}
+	if ph.timeout > ph.maxTimeout {
+		ph.timeout = ph.maxTimeout
 	}
 	if s.PushAuth != nil {
 		ph.authFunc = s.PushAuth
 	}
+	ph.policy = s.PushPolicy
+	ph.limit = s.PushLimit
+	ph.caller = defaultPushCaller
+	if s.PushCaller != nil {
+		ph.caller = s.PushCaller
+	}
+	ph.callbackHosts = s.CallbackHosts
 	s.ph = &ph
-	http.Handle(s.PushPath, s.ph)
 
-	return http.ListenAndServe(s.Addr, nil)
+	// drop request handler
+	s.dh = &dropHandler{
+		authFunc:  s.PushAuth,
+		wh:        s.wh,
+		authorize: s.ph.authorize,
+	}
+
+	// broadcast request handler
+	s.bh = &broadcastHandler{
+		authFunc: s.PushAuth,
+		ph:       s.ph,
+	}
+
+	// lookup request handler
+	s.lh = &lookupHandler{
+		authFunc:  s.PushAuth,
+		cm:        cm,
+		authorize: s.ph.authorize,
+	}
 }
 
-// Push filters connections by userID and event, then write message
+// Push filters connections by userID and event, then write message to the
+// newest of them. The event is ignored if it's empty.
 func (s *Server) Push(userID, event, message string) (*CommObject, error) {
-	return s.ph.push(userID, event, message)
+	_, ph, err := s.handlers()
+	if err != nil {
+		return nil, err
+	}
+
+	commID := uuid.New().String()
+	return ph.push(userID, commID, content{msg: jsonString(message)}, PushNewest, event, ph.timeout)
+}
+
+// Call pushes message to the newest connection of userID and waits for its
+// response. It gives up when ctx is done and returns the error of ctx. The
+// command times out as ctx does, or after PushTimeout if ctx has no deadline.
+// A failure reported by the client is returned as *ClientError.
+func (s *Server) Call(ctx context.Context, userID string, message json.RawMessage) (*CommResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, ph, err := s.handlers()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := ph.timeout
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		timeout = time.Until(deadline)
+	}
+
+	commID := uuid.New().String()
+	obj, err := ph.push(userID, commID, content{msg: message}, PushNewest, "", timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer ph.removeCommand(userID, commID)
+
+	err = ph.waitContext(ctx, obj)
+	if err == ErrTimeout && hasDeadline {
+		// the command expires with ctx, which is done by now
+		<-ctx.Done()
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj.response, nil
+}
+
+// Send pushes message to the newest connection of userID without waiting for
+// a response, the client receives it with NoReply set. It returns once the
+// message is queued.
+func (s *Server) Send(userID string, message json.RawMessage) error {
+	_, ph, err := s.handlers()
+	if err != nil {
+		return err
+	}
+
+	commID := uuid.New().String()
+	if _, err := ph.push(userID, commID, content{msg: message, noReply: true}, PushNewest, "", ph.timeout); err != nil {
+		return err
+	}
+	ph.removeCommand(userID, commID)
+	return nil
+}
+
+// Handle registers fn to handle requests of clients calling method. It may be
+// called while the server is running.
+func (s *Server) Handle(method string, fn HandlerFunc) {
+	s.router.handle(method, fn)
+}
+
+// Use appends middleware wrapping the handlers of requests of clients, the
+// first one registered is the outermost.
+func (s *Server) Use(mw ...Middleware) {
+	s.router.use(mw...)
+}
+
+// Reauth asks the connections of userID on this node to reauthenticate in
+// grace, they're closed if they don't. It returns the number of connections
+// asked. It's used to end sessions whose credentials are revoked.
+func (s *Server) Reauth(userID string, grace time.Duration) int {
+	wh, _, err := s.handlers()
+	if err != nil {
+		return 0
+	}
+
+	conns := wh.cm.conns(userID)
+	for _, conn := range conns {
+		conn.requireReauth(grace)
+	}
+	return len(conns)
+}
+
+// Multicast pushes message to users in userIDs, filtered by event if it's
+// not empty, then waits for their responses. The result of each user is
+// returned by userID.
+func (s *Server) Multicast(userIDs []string, event, message string) map[string]*PushResult {
+	_, ph, err := s.handlers()
+	if err != nil {
+		results := make(map[string]*PushResult)
+		for _, userID := range dedup(userIDs) {
+			results[userID] = &PushResult{Error: err.Error(), Code: errorCode(err)}
+		}
+		return results
+	}
+
+	commID := uuid.New().String()
+	return ph.pushMany(dedup(userIDs), commID, content{msg: jsonString(message)}, PushNewest, event, ph.timeout)
+}
+
+// Broadcast is like Multicast, but pushes message to every connected user.
+func (s *Server) Broadcast(event, message string) map[string]*PushResult {
+	_, ph, err := s.handlers()
+	if err != nil {
+		return map[string]*PushResult{}
+	}
+	return s.Multicast(ph.cm.users(event), event, message)
+}
+
+// Lookup returns the presence of each user in userIDs, including metadata of
+// their connections.
+func (s *Server) Lookup(userIDs ...string) []*Presence {
+	wh, _, err := s.handlers()
+	if err != nil {
+		return nil
+	}
+	return wh.cm.presences(userIDs)
 }
 
 // Drop find connections by userID and event, then close them. The userID can't
-// be empty. The event is ignored if it's empty.
+// be empty. The event is ignored if it's empty. Commands still waiting for a
+// response from the dropped connections fail with ErrConnDropped.
 func (s *Server) Drop(userID, event string) (int, error) {
-	return s.wh.closeConns(userID, event)
+	wh, _, err := s.handlers()
+	if err != nil {
+		return 0, err
+	}
+	return wh.closeConns(userID, event)
+}
+
+// handlers returns the handlers used by the methods above. They're created
+// like by Handler if the server is not started yet, which fails if the
+// parameters of Server are illegal.
+func (s *Server) handlers() (*websocketHandler, *pushHandler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.setup(); err != nil {
+		return nil, nil, err
+	}
+	return s.wh, s.ph, nil
 }
 
 // Check parameters of Server, returns error if fail.
-func (s Server) check() error {
-	if !checkPath(s.WSPath) {
-		return fmt.Errorf("WSPath: %s not illegal", s.WSPath)
+func (s *Server) check() error {
+	if s.WSPath == "" {
+		return errors.New("WSPath can't be empty")
 	}
-	if !checkPath(s.PushPath) {
-		return fmt.Errorf("PushPath: %s not illegal", s.PushPath)
+
+	paths := []struct {
+		name string
+		path string
+	}{
+		{"WSPath", s.WSPath},
+		{"PushPath", s.PushPath},
+		{"DropPath", s.DropPath},
+		{"BroadcastPath", s.BroadcastPath},
+		{"LookupPath", s.LookupPath},
 	}
-	if s.WSPath == s.PushPath {
-		return errors.New("WSPath is equal to PushPath")
+	used := make(map[string]string)
+	for _, p := range paths {
+		if !checkPath(p.path) {
+			return fmt.Errorf("%s: %s not illegal", p.name, p.path)
+		}
+		if p.path == "" {
+			continue
+		}
+		if other, ok := used[p.path]; ok {
+			return fmt.Errorf("%s is equal to %s", p.name, other)
+		}
+		used[p.path] = p.name
+	}
+
+	if s.Broker != nil && s.Presence == nil {
+		return errors.New("Presence is required with Broker")
 	}
 
 	return nil
@@ -121,6 +733,16 @@ func NewServer(addr string) *Server {
 		Addr:     addr,
 		WSPath:   serverDefaultWSPath,
 		PushPath: serverDefaultPushPath,
+		DropPath: serverDefaultDropPath,
+
+		BroadcastPath: serverDefaultBroadcastPath,
+		LookupPath:    serverDefaultLookupPath,
+
+		SendQueueSize: serverDefaultSendQueueSize,
+		WriteWait:     serverDefaultWriteWait,
+
+		PushTimeout:    serverDefaultPushTimeout,
+		MaxPushTimeout: serverDefaultMaxPushTimeout,
 	}
 }
 
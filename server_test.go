@@ -2,12 +2,18 @@ package wserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,7 +45,7 @@ func Test_Server_1(t *testing.T) {
 			pm := CommMessage{
 				UserID:  userID,
 				CommID:  uuid.New().String(),
-				Message: fmt.Sprintf("Hello in %d", i),
+				Message: jsonString(fmt.Sprintf("Hello in %d", i)),
 			}
 			b, _ := json.Marshal(pm)
 
@@ -89,7 +95,7 @@ func runBasicClient(userID, server string, done chan struct{}) error {
 			log.Printf("recv: %s", message)
 			wsm := WSMessage{
 				Kind: NormalMessageType,
-				Body: string(message),
+				Body: message,
 			}
 
 			strMsg, _ := json.Marshal(wsm)
@@ -107,7 +113,7 @@ func runBasicClient(userID, server string, done chan struct{}) error {
 	strRm, _ := json.Marshal(rm)
 	msg := WSMessage{
 		Kind: RegisterMessageType,
-		Body: string(strRm),
+		Body: strRm,
 	}
 
 	strMsg, _ := json.Marshal(msg)
@@ -128,3 +134,1570 @@ func runBasicClient(userID, server string, done chan struct{}) error {
 		}
 	}
 }
+
+func Test_Server_Drop(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "news")
+	defer c.Close()
+
+	body := strings.NewReader(fmt.Sprintf(`{"userId":%q,"event":"other"}`, userID))
+	resp, err := http.Post(ts.URL+s.DropPath, "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(b)) != `{"dropped":0}` {
+		t.Fatalf("drop with other event: %s", b)
+	}
+
+	n, err := s.Drop(userID, "news")
+	if err != nil || n != 1 {
+		t.Fatalf("Drop returns %d, %v", n, err)
+	}
+
+	_, _, err = c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expect policy violation close, got %v", err)
+	}
+	if found, _ := s.wh.cm.hasUser(userID); found {
+		t.Fatal("user is still bound after drop")
+	}
+}
+
+func Test_Server_AsyncPush(t *testing.T) {
+	s := NewServer("")
+	s.CallbackHosts = []string{"127.0.0.1:*"}
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+	go echoCommands(c)
+
+	results := make(chan AsyncResult, 1)
+	cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res AsyncResult
+		json.NewDecoder(r.Body).Decode(&res)
+		results <- res
+	}))
+	defer cb.Close()
+
+	commID := uuid.New().String()
+	b, _ := json.Marshal(CommMessage{
+		UserID:   userID,
+		CommID:   commID,
+		Message:  jsonString("hello"),
+		Async:    true,
+		Callback: cb.URL,
+	})
+	resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expect 202, got %d", resp.StatusCode)
+	}
+
+	select {
+	case res := <-results:
+		if res.Status != AsyncDone || res.CommID != commID {
+			t.Fatalf("unexpected callback result: %+v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback is not called")
+	}
+
+	resp, err = http.Get(ts.URL + s.PushPath + "/" + commID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res AsyncResult
+	json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if res.Status != AsyncDone || string(res.Message) != `"hello"` {
+		t.Fatalf("unexpected polled result: %+v", res)
+	}
+
+	// the result is not served to other callers
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+s.PushPath+"/"+commID, nil)
+	req.Header.Set("Authorization", "another caller")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("result of another caller: %d", resp.StatusCode)
+	}
+
+	// another caller may use the same command ID
+	b, _ = json.Marshal(CommMessage{UserID: userID, CommID: commID, Message: jsonString("again"), Async: true})
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+s.PushPath, bytes.NewReader(b))
+	req.Header.Set("Authorization", "another caller")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("same command ID of another caller: %d", resp.StatusCode)
+	}
+
+	// callbacks are posted to the hosts allowed only
+	b, _ = json.Marshal(CommMessage{
+		UserID:   userID,
+		CommID:   uuid.New().String(),
+		Message:  jsonString("hello"),
+		Async:    true,
+		Callback: "http://169.254.169.254/latest",
+	})
+	resp, err = http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("callback not allowed: %d", resp.StatusCode)
+	}
+}
+
+func Test_Server_PushTimeout(t *testing.T) {
+	s := NewServer("")
+	s.MaxPushTimeout = 200 * time.Millisecond
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+
+	b, _ := json.Marshal(CommMessage{
+		UserID:  userID,
+		CommID:  uuid.New().String(),
+		Message: jsonString("never answered"),
+		Timeout: 10000,
+	})
+	start := time.Now()
+	resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout is not bounded by MaxPushTimeout, took %v", elapsed)
+	}
+
+	var req CommRequest
+	if err := c.ReadJSON(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Timeout != 200 || req.Deadline == 0 {
+		t.Fatalf("unexpected deadline in request: %+v", req)
+	}
+}
+
+func Test_Server_MultiConn(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	phone := dialAndRegister(t, s, ts, userID, "")
+	defer phone.Close()
+	go echoCommands(phone)
+	browser := dialAndRegister(t, s, ts, userID, "")
+	defer browser.Close()
+	go echoCommands(browser)
+	waitConns(t, s, userID, 2)
+
+	push := func(mode string) string {
+		b, _ := json.Marshal(CommMessage{
+			UserID:  userID,
+			CommID:  uuid.New().String(),
+			Message: jsonString("hi"),
+			Mode:    mode,
+		})
+		resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return strings.TrimSpace(string(body))
+	}
+
+	if got := push(PushAll); got != `["hi","hi"]` {
+		t.Fatalf("push all: %s", got)
+	}
+	if got := push(PushFirst); got != "hi" {
+		t.Fatalf("push first: %s", got)
+	}
+	if got := push(""); got != "hi" {
+		t.Fatalf("push newest: %s", got)
+	}
+
+	phone.Close()
+	waitConns(t, s, userID, 1)
+	if got := push(PushAll); got != `["hi"]` {
+		t.Fatalf("push all after unbind: %s", got)
+	}
+}
+
+func Test_Server_EventPush(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	alice, bob := uuid.New().String(), uuid.New().String()
+	ca := dialAndRegister(t, s, ts, alice, "dashboard")
+	defer ca.Close()
+	cb := dialAndRegister(t, s, ts, bob, "")
+	defer cb.Close()
+
+	subscribe := func(c *websocket.Conn, kind int, events ...string) {
+		body, _ := json.Marshal(SubscribeMessage{Events: events})
+		msg, _ := json.Marshal(WSMessage{Kind: kind, Body: body})
+		if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscribe(cb, SubscribeMessageType, "dashboard", "billing", "stale")
+	subscribe(cb, UnsubscribeMessageType, "stale")
+	for i := 0; i < 100 && (len(s.wh.cm.subscribers("billing")) == 0 ||
+		len(s.wh.cm.subscribers("stale")) != 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if users := s.wh.cm.subscribers("stale"); len(users) != 0 {
+		t.Fatalf("unsubscribed event still has subscribers: %v", users)
+	}
+	go echoCommands(ca)
+	go echoCommands(cb)
+
+	push := func(userID, event string) (int, string) {
+		b, _ := json.Marshal(CommMessage{
+			UserID:  userID,
+			Event:   event,
+			CommID:  uuid.New().String(),
+			Message: jsonString("update"),
+		})
+		resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	_, got := push("", "dashboard")
+	var results map[string]PushResult
+	json.Unmarshal([]byte(got), &results)
+	if len(results) != 2 || string(results[alice].Message) != `"update"` || string(results[bob].Message) != `"update"` {
+		t.Fatalf("push event to all users: %s", got)
+	}
+
+	if code, _ := push(alice, "billing"); code == http.StatusOK {
+		t.Fatal("push to user not subscribed to the event should fail")
+	}
+	if code, got := push(bob, "billing"); code != http.StatusOK || got != "update" {
+		t.Fatalf("push to user and event: %d %s", code, got)
+	}
+}
+
+func Test_Server_Broadcast(t *testing.T) {
+	s := NewServer("")
+	s.PushTimeout = 200 * time.Millisecond
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	users := make([]string, 3)
+	for i := range users {
+		users[i] = uuid.New().String()
+		c := dialAndRegister(t, s, ts, users[i], "")
+		defer c.Close()
+		// the last user never answers
+		if i < len(users)-1 {
+			go echoCommands(c)
+		}
+	}
+
+	b, _ := json.Marshal(BroadcastMessage{
+		UserIDs: []string{users[0], users[1], "nobody"},
+		CommID:  uuid.New().String(),
+		Message: jsonString("hi"),
+	})
+	resp, err := http.Post(ts.URL+s.BroadcastPath, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results map[string]PushResult
+	json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if len(results) != 3 || string(results[users[0]].Message) != `"hi"` ||
+		string(results[users[1]].Message) != `"hi"` || results["nobody"].Error == "" {
+		t.Fatalf("unexpected multicast results: %+v", results)
+	}
+
+	all := s.Broadcast("", "hello")
+	if len(all) != 3 || string(all[users[0]].Message) != `"hello"` || all[users[2]].Error == "" {
+		t.Fatalf("unexpected broadcast results: %+v", all)
+	}
+}
+
+func Test_Conn_QueuePolicy(t *testing.T) {
+	upgraded := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := defaultUpgrader.Upgrade(w, r, nil)
+		upgraded <- c
+	}))
+	defer ts.Close()
+
+	// newConn returns a Conn whose writer is not running, so its queue of
+	// one message never drains
+	newConn := func(policy QueuePolicy) *Conn {
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+
+		wh := &websocketHandler{
+			sendQueueSize: 1,
+			writeWait:     50 * time.Millisecond,
+			queuePolicy:   policy,
+		}
+		return NewConn(<-upgraded, wh)
+	}
+
+	c := newConn(QueueBlock)
+	c.Write([]byte("a"))
+	if _, err := c.Write([]byte("b")); err != ErrQueueFull {
+		t.Fatalf("block: expect ErrQueueFull, got %v", err)
+	}
+
+	c = newConn(QueueDropOldest)
+	c.Write([]byte("a"))
+	if _, err := c.Write([]byte("b")); err != nil {
+		t.Fatalf("drop oldest: %v", err)
+	}
+	if p := <-c.sendCh; string(p) != "b" {
+		t.Fatalf("drop oldest: expect b queued, got %s", p)
+	}
+
+	c = newConn(QueueDisconnect)
+	c.Write([]byte("a"))
+	if _, err := c.Write([]byte("b")); err != ErrQueueFull {
+		t.Fatalf("disconnect: expect ErrQueueFull, got %v", err)
+	}
+	if err := c.Close(); err == nil {
+		t.Fatal("disconnect: slow connection is not closed")
+	}
+}
+
+func Test_Server_Heartbeat(t *testing.T) {
+	dead := make(chan error, 2)
+
+	s := NewServer("")
+	s.PongWait = 200 * time.Millisecond
+	s.PingInterval = 50 * time.Millisecond
+	s.OnDeadPeer = func(conn *Conn, reason error) {
+		dead <- reason
+	}
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	// pongs are only sent while the client reads
+	alive, silent := uuid.New().String(), uuid.New().String()
+	ca := dialAndRegister(t, s, ts, alive, "")
+	defer ca.Close()
+	go echoCommands(ca)
+	cs := dialAndRegister(t, s, ts, silent, "")
+	defer cs.Close()
+
+	select {
+	case reason := <-dead:
+		if reason != ErrPongTimeout {
+			t.Fatalf("expect ErrPongTimeout, got %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent peer is not detected")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if found, _ := s.wh.cm.hasUser(silent); found {
+		t.Fatal("dead peer is still bound")
+	}
+	if found, _ := s.wh.cm.hasUser(alive); !found {
+		t.Fatal("alive peer is unbound")
+	}
+}
+
+func Test_Server_Shutdown(t *testing.T) {
+	s := NewServer("")
+	s.MaxPushTimeout = 10 * time.Second
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+
+	// a push never answered by the client
+	pushed := make(chan int)
+	go func() {
+		b, _ := json.Marshal(CommMessage{
+			UserID:  userID,
+			CommID:  uuid.New().String(),
+			Message: jsonString("hi"),
+			Timeout: 10000,
+		})
+		resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+		if err != nil {
+			pushed <- 0
+			return
+		}
+		resp.Body.Close()
+		pushed <- resp.StatusCode
+	}()
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expect going away close, got %v", err)
+	}
+	select {
+	case code := <-pushed:
+		if code == http.StatusOK {
+			t.Fatal("pending push should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending push is not failed by Shutdown")
+	}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil ||
+		resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade after shutdown should fail with 503, got %v", err)
+	}
+}
+
+func Test_Server_Handler(t *testing.T) {
+	bad := NewServer("")
+	bad.PushPath = bad.WSPath
+	if _, err := bad.Handler(); err == nil {
+		t.Fatal("Handler should fail if paths are equal")
+	}
+	if err := bad.ListenAndServe(); err == nil {
+		t.Fatal("ListenAndServe should fail if paths are equal")
+	}
+
+	s := NewServer("")
+	h, err := s.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rt/", http.StripPrefix("/rt", h))
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/rt" + s.WSPath
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rm, _ := json.Marshal(RegisterMessage{Token: userID})
+	c.WriteJSON(WSMessage{Kind: RegisterMessageType, Body: rm})
+
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(ts.URL + "/rt" + s.LookupPath + "?userid=" + userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("user is not found under the prefix")
+}
+
+func Test_Server_Serve(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("")
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	url := fmt.Sprintf("ws://%s%s", l.Addr(), s.WSPath)
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("expect http.ErrServerClosed, got %v", err)
+	}
+}
+
+func Test_Server_Lookup(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	alice, bob := "alice", "bob"
+	c1 := dialAndRegister(t, s, ts, alice, "news")
+	defer c1.Close()
+	c2 := dialAndRegister(t, s, ts, alice, "")
+	defer c2.Close()
+	c3 := dialAndRegister(t, s, ts, bob, "")
+	defer c3.Close()
+	waitConns(t, s, alice, 2)
+
+	getJSON := func(resp *http.Response, err error, v interface{}) int {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(v)
+		return resp.StatusCode
+	}
+
+	var p Presence
+	resp, err := http.Get(ts.URL + s.LookupPath + "?userid=" + alice)
+	if code := getJSON(resp, err, &p); code != http.StatusOK {
+		t.Fatalf("lookup alice: %d", code)
+	}
+	if !p.Online || len(p.Conns) != 2 || p.Conns[0].ID == "" ||
+		len(p.Conns[0].Events) != 1 || p.Conns[0].RemoteAddr == "" {
+		t.Fatalf("unexpected presence: %+v", p)
+	}
+
+	resp, err = http.Get(ts.URL + s.LookupPath + "?userid=nobody")
+	if code := getJSON(resp, err, &p); code != http.StatusNotFound {
+		t.Fatalf("lookup nobody: %d", code)
+	}
+
+	var ps []Presence
+	body := strings.NewReader(`{"userIds":["bob","nobody"]}`)
+	resp, err = http.Post(ts.URL+s.LookupPath, "application/json", body)
+	getJSON(resp, err, &ps)
+	if len(ps) != 2 || !ps[0].Online || ps[1].Online {
+		t.Fatalf("unexpected bulk lookup: %+v", ps)
+	}
+
+	var pl PresenceList
+	resp, err = http.Get(ts.URL + s.LookupPath + "?offset=1&limit=1")
+	getJSON(resp, err, &pl)
+	if pl.Total != 2 || len(pl.Users) != 1 || pl.Users[0].UserID != bob {
+		t.Fatalf("unexpected list: %+v", pl)
+	}
+}
+
+func Test_Server_ErrorResponse(t *testing.T) {
+	s := NewServer("")
+	s.PushTimeout = 100 * time.Millisecond
+	s.PushAuth = func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "secret"
+	}
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+
+	push := func(msg CommMessage, auth string) (int, ErrorResponse) {
+		b, _ := json.Marshal(msg)
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+s.PushPath, bytes.NewReader(b))
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var er ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&er)
+		return resp.StatusCode, er
+	}
+
+	cases := []struct {
+		msg       CommMessage
+		auth      string
+		status    int
+		code      string
+		retryable bool
+	}{
+		{CommMessage{UserID: userID, CommID: "1", Message: jsonString("hi")}, "", http.StatusUnauthorized, CodeUnauthorized, false},
+		{CommMessage{UserID: userID, Message: jsonString("hi")}, "secret", http.StatusBadRequest, CodeRequestIllegal, false},
+		{CommMessage{UserID: "nobody", CommID: "2", Message: jsonString("hi")}, "secret", http.StatusNotFound, CodeUserNotConnected, true},
+		// the client never answers
+		{CommMessage{UserID: userID, CommID: "3", Message: jsonString("hi")}, "secret", http.StatusGatewayTimeout, CodeTimeout, true},
+		{CommMessage{UserID: userID, CommID: "4", Message: jsonString("hi"), Async: true}, "secret", http.StatusAccepted, "", false},
+		{CommMessage{UserID: userID, CommID: "4", Message: jsonString("hi"), Async: true}, "secret", http.StatusConflict, CodeDuplicateCommand, false},
+	}
+	for i, tc := range cases {
+		status, er := push(tc.msg, tc.auth)
+		if status != tc.status || er.Code != tc.code || er.Retryable != tc.retryable {
+			t.Fatalf("case %d: %d %+v", i, status, er)
+		}
+	}
+
+	// the connection is closed while the command is waiting
+	done := make(chan ErrorResponse)
+	go func() {
+		status, er := push(CommMessage{UserID: userID, CommID: "5", Message: jsonString("hi"), Timeout: 5000}, "secret")
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("push to closed connection: %d", status)
+		}
+		done <- er
+	}()
+	for {
+		var req CommRequest
+		if err := c.ReadJSON(&req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Id == "5" {
+			break
+		}
+	}
+	c.Close()
+	if er := <-done; er.Code != CodeConnClosed || !er.Retryable {
+		t.Fatalf("push to closed connection: %+v", er)
+	}
+}
+
+func Test_Server_ClientError(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+
+	// the client fails every command
+	go func() {
+		for {
+			var req CommRequest
+			if err := c.ReadJSON(&req); err != nil {
+				return
+			}
+			cr, _ := json.Marshal(CommResponse{
+				Id:     req.Id,
+				Status: CommStatusError,
+				Code:   "E_DISK",
+				Error:  "disk full",
+			})
+			c.WriteJSON(WSMessage{Kind: NormalMessageType, Body: cr})
+		}
+	}()
+
+	b, _ := json.Marshal(CommMessage{UserID: userID, CommID: uuid.New().String(), Message: jsonString("save")})
+	resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var er ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&er)
+	if resp.StatusCode != http.StatusBadGateway || er.Code != CodeClientError ||
+		er.ClientCode != "E_DISK" || er.Message != "disk full" || er.Retryable {
+		t.Fatalf("push failed by client: %d %+v", resp.StatusCode, er)
+	}
+
+	obj, err := s.Push(userID, "", "save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ce *ClientError
+	if err := s.ph.wait(obj); !errors.As(err, &ce) || ce.Code != "E_DISK" {
+		t.Fatalf("wait for command failed by client: %v", err)
+	}
+}
+
+func Test_Server_JSONPayload(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+	dial := func(userID string, version int) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rm, _ := json.Marshal(RegisterMessage{Token: userID, Version: version})
+		c.WriteJSON(WSMessage{Kind: RegisterMessageType, Body: rm})
+		if version >= ProtocolVersion2 {
+			var ack CommRequest
+			if err := c.ReadJSON(&ack); err != nil || ack.Register == nil || ack.Register.UserID != userID {
+				t.Fatalf("register acknowledged with %+v: %v", ack.Register, err)
+			}
+		}
+		waitConns(t, s, userID, 1)
+		return c
+	}
+
+	// the client receives the message as it is, and responds an object
+	modern := uuid.New().String()
+	cm := dial(modern, ProtocolVersion2)
+	defer cm.Close()
+	go func() {
+		var req struct {
+			Id  string
+			Msg struct{ Args []int }
+		}
+		if err := cm.ReadJSON(&req); err != nil {
+			return
+		}
+		cr, _ := json.Marshal(map[string]interface{}{
+			"id":  req.Id,
+			"msg": map[string]int{"sum": req.Msg.Args[0] + req.Msg.Args[1]},
+		})
+		cm.WriteJSON(WSMessage{Kind: NormalMessageType, Body: cr})
+	}()
+
+	// the legacy client receives the message encoded as string
+	legacy := uuid.New().String()
+	cl := dial(legacy, 0)
+	defer cl.Close()
+	go func() {
+		var req struct {
+			Id  string
+			Msg string
+		}
+		if err := cl.ReadJSON(&req); err != nil {
+			return
+		}
+		cr, _ := json.Marshal(CommResponse{Id: req.Id, Msg: jsonString(req.Msg)})
+		cl.WriteJSON(WSMessage{Kind: NormalMessageType, Body: jsonString(string(cr))})
+	}()
+
+	push := func(userID string) (string, string) {
+		b, _ := json.Marshal(CommMessage{
+			UserID:  userID,
+			CommID:  uuid.New().String(),
+			Message: json.RawMessage(`{"args":[1,2]}`),
+		})
+		resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	if ct, got := push(modern); ct != "application/json" || got != `{"sum":3}` {
+		t.Fatalf("push to version 2 client: %s %s", ct, got)
+	}
+	if ct, got := push(legacy); !strings.HasPrefix(ct, "text/plain") || got != `{"args":[1,2]}` {
+		t.Fatalf("push to version 1 client: %s %s", ct, got)
+	}
+}
+
+func Test_Server_Codec(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+
+	// each client reads the data of the request and responds it reversed
+	tests := []struct {
+		codec   Codec
+		request func(p []byte) (id string, data []byte)
+		respond func(id string, data []byte) []byte
+	}{
+		{
+			codec: JSONCodec{},
+			request: func(p []byte) (string, []byte) {
+				var cr CommRequest
+				json.Unmarshal(p, &cr)
+				return cr.Id, cr.Data
+			},
+			respond: func(id string, data []byte) []byte {
+				body, _ := json.Marshal(CommResponse{Id: id, Data: data})
+				p, _ := json.Marshal(WSMessage{Kind: NormalMessageType, Body: body})
+				return p
+			},
+		},
+		{
+			codec: MsgPackCodec{},
+			request: func(p []byte) (string, []byte) {
+				v, _ := decodeMsgPack(bytes.NewReader(p), 0)
+				m, _ := v.(map[string]interface{})
+				id, _ := m["id"].(string)
+				data, _ := m["data"].([]byte)
+				return id, data
+			},
+			respond: func(id string, data []byte) []byte {
+				var buf bytes.Buffer
+				encodeMsgPackFields(&buf, []msgpackField{
+					{"Kind", int64(NormalMessageType)},
+					{"Body", map[string]interface{}{"id": id, "data": data}},
+				})
+				return buf.Bytes()
+			},
+		},
+		{
+			codec: ProtoCodec{},
+			request: func(p []byte) (id string, data []byte) {
+				readProto(p, func(num int, _ uint64, b []byte) error {
+					switch num {
+					case 1:
+						id = string(b)
+					case 5:
+						data = b
+					}
+					return nil
+				})
+				return id, data
+			},
+			respond: func(id string, data []byte) []byte {
+				var resp []byte
+				resp = appendProtoBytes(resp, 1, []byte(id))
+				resp = appendProtoBytes(resp, 6, data)
+				p := appendProtoVarint(nil, 1, NormalMessageType)
+				return appendProtoBytes(p, 3, resp)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		dialer := websocket.Dialer{Subprotocols: []string{tt.codec.Name()}}
+		c, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if c.Subprotocol() != tt.codec.Name() {
+			t.Fatalf("negotiated %q, want %q", c.Subprotocol(), tt.codec.Name())
+		}
+
+		// register in the codec as well
+		userID := uuid.New().String()
+		rm, _ := json.Marshal(RegisterMessage{Token: userID, Version: ProtocolVersion2})
+		p, err := tt.codec.Marshal(&WSMessage{Kind: RegisterMessageType, Body: rm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.WriteMessage(tt.codec.MessageType(), p)
+		if _, _, err := c.ReadMessage(); err != nil {
+			// the register result
+			t.Fatal(err)
+		}
+		waitConns(t, s, userID, 1)
+
+		codec, request, respond := tt.codec, tt.request, tt.respond
+		go func() {
+			mt, p, err := c.ReadMessage()
+			if err != nil || mt != codec.MessageType() {
+				return
+			}
+			id, data := request(p)
+			reversed := make([]byte, len(data))
+			for i, b := range data {
+				reversed[len(data)-1-i] = b
+			}
+			c.WriteMessage(codec.MessageType(), respond(id, reversed))
+		}()
+
+		resp, err := http.Post(ts.URL+s.PushPath+"?userId="+userID+"&commId=1",
+			"application/octet-stream", bytes.NewReader([]byte{0, 1, 2, 0xff}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" ||
+			!bytes.Equal(body, []byte{0xff, 2, 1, 0}) {
+			t.Fatalf("%s: push binary data: %s %v", tt.codec.Name(), ct, body)
+		}
+	}
+
+	// message and data can't be pushed together
+	b, _ := json.Marshal(CommMessage{UserID: "u", CommID: "1", Message: jsonString("hi"), Data: []byte{1}})
+	resp, err := http.Post(ts.URL+s.PushPath, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("push message and data: status %d", resp.StatusCode)
+	}
+}
+
+func Test_Server_Call(t *testing.T) {
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+
+	// the client answers a command with its message reversed, and records
+	// the ones needing no reply
+	noReply := make(chan *CommRequest, 1)
+	go func() {
+		for {
+			var req CommRequest
+			if err := c.ReadJSON(&req); err != nil {
+				return
+			}
+			if req.NoReply {
+				noReply <- &req
+				continue
+			}
+			if string(payload(req.Msg)) == "silent" {
+				continue
+			}
+			msg := []rune(string(payload(req.Msg)))
+			for i, j := 0, len(msg)-1; i < j; i, j = i+1, j-1 {
+				msg[i], msg[j] = msg[j], msg[i]
+			}
+			cr, _ := json.Marshal(CommResponse{Id: req.Id, Msg: jsonString(string(msg))})
+			c.WriteJSON(WSMessage{Kind: NormalMessageType, Body: cr})
+		}
+	}()
+
+	commands := func() int {
+		s.wh.cm.mu.RLock()
+		defer s.wh.cm.mu.RUnlock()
+		return len(s.wh.cm.userConnCommMap[userID].commMap)
+	}
+
+	resp, err := s.Call(context.Background(), userID, jsonString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload(resp.Msg)) != "olleh" {
+		t.Fatalf("call responded %s", resp.Msg)
+	}
+
+	// cancelled while the client doesn't respond
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := s.Call(ctx, userID, jsonString("silent")); err != context.Canceled {
+		t.Fatalf("cancelled call: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Call(ctx, userID, jsonString("silent")); err != context.DeadlineExceeded {
+		t.Fatalf("expired call: %v", err)
+	}
+	if n := commands(); n != 0 {
+		t.Fatalf("%d commands left after call", n)
+	}
+
+	if _, err := s.Call(context.Background(), uuid.New().String(), jsonString("hello")); !errors.Is(err, ErrUserNotConnected) {
+		t.Fatalf("call to absent user: %v", err)
+	}
+
+	if err := s.Send(userID, jsonString("fire")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req := <-noReply:
+		if string(payload(req.Msg)) != "fire" {
+			t.Fatalf("send delivered %s", req.Msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message sent not received")
+	}
+	if n := commands(); n != 0 {
+		t.Fatalf("%d commands left after send", n)
+	}
+}
+
+func Test_Server_NotStarted(t *testing.T) {
+	s := NewServer("")
+
+	// set up by the first call, even racing with Handler
+	done := make(chan struct{})
+	go func() {
+		s.Handler()
+		close(done)
+	}()
+	if _, err := s.Call(context.Background(), "alice", json.RawMessage(`{}`)); err != ErrUserNotConnected {
+		t.Fatalf("call before start: %v", err)
+	}
+	<-done
+	if err := s.Send("alice", json.RawMessage(`{}`)); err != ErrUserNotConnected {
+		t.Fatalf("send before start: %v", err)
+	}
+	if n := s.Reauth("alice", time.Second); n != 0 {
+		t.Fatalf("reauth before start: %d", n)
+	}
+	if n, _ := s.Drop("alice", ""); n != 0 {
+		t.Fatalf("drop before start: %d", n)
+	}
+	if ps := s.Lookup("alice"); len(ps) != 1 || ps[0].Online {
+		t.Fatalf("lookup before start: %+v", ps)
+	}
+
+	// illegal parameters are reported instead
+	bad := NewServer("")
+	bad.WSPath = ""
+	if err := bad.Send("alice", json.RawMessage(`{}`)); err == nil {
+		t.Fatal("send with illegal parameters")
+	}
+	if results := bad.Multicast([]string{"alice"}, "", "hi"); results["alice"] == nil || results["alice"].Error == "" {
+		t.Fatalf("multicast with illegal parameters: %+v", results)
+	}
+}
+
+func Test_Server_Handle(t *testing.T) {
+	s := NewServer("")
+	s.MaxRequests = 1
+	s.Handle("panic", func(ctx context.Context, req *Request) (json.RawMessage, error) {
+		panic("boom")
+	})
+	release := make(chan struct{})
+	s.Handle("block", func(ctx context.Context, req *Request) (json.RawMessage, error) {
+		<-release
+		return nil, nil
+	})
+	s.Handle("sum", func(ctx context.Context, req *Request) (json.RawMessage, error) {
+		var args []int
+		if err := json.Unmarshal(req.Params, &args); err != nil {
+			return nil, &HandlerError{Code: "bad_params", Message: err.Error()}
+		}
+		return json.Marshal(map[string]interface{}{"sum": args[0] + args[1], "user": req.UserID})
+	})
+
+	// the middleware rejects a method and counts requests reaching it
+	var calls int32
+	s.Use(func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (json.RawMessage, error) {
+			atomic.AddInt32(&calls, 1)
+			if req.Method == "secret" {
+				return nil, ErrUnauthorized
+			}
+			return next(ctx, req)
+		}
+	})
+
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+
+	call := func(c *websocket.Conn, id, method, params string) *Reply {
+		body, _ := json.Marshal(Request{Id: id, Method: method, Params: json.RawMessage(params)})
+		c.WriteJSON(WSMessage{Kind: RequestMessageType, Body: body})
+
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		var cr CommRequest
+		if err := c.ReadJSON(&cr); err != nil {
+			t.Fatal(err)
+		}
+		if cr.Reply == nil || cr.Reply.Id != id {
+			t.Fatalf("request %s got %+v", id, cr)
+		}
+		return cr.Reply
+	}
+
+	r := call(c, "1", "sum", "[1,2]")
+	if r.Status != CommStatusOK || string(r.Result) != fmt.Sprintf(`{"sum":3,"user":"%s"}`, userID) {
+		t.Fatalf("sum replied %+v", r)
+	}
+	if r := call(c, "2", "sum", `"x"`); r.Status != CommStatusError || r.Code != "bad_params" {
+		t.Fatalf("bad params replied %+v", r)
+	}
+	if r := call(c, "3", "nothing", ""); r.Code != CodeNoSuchMethod {
+		t.Fatalf("unknown method replied %+v", r)
+	}
+	if r := call(c, "4", "secret", ""); r.Code != CodeUnauthorized {
+		t.Fatalf("rejected method replied %+v", r)
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("middleware called %d times", n)
+	}
+
+	// a panic is replied, the server keeps running
+	if r := call(c, "5", "panic", ""); r.Status != CommStatusError || r.Code != CodeInternal {
+		t.Fatalf("panic replied %+v", r)
+	}
+
+	// one request at once
+	body, _ := json.Marshal(Request{Id: "6", Method: "block"})
+	c.WriteJSON(WSMessage{Kind: RequestMessageType, Body: body})
+	if r := call(c, "7", "sum", "[1,2]"); r.Code != CodeTooManyRequests {
+		t.Fatalf("request beyond MaxRequests replied %+v", r)
+	}
+	close(release)
+	var cr CommRequest
+	if err := c.ReadJSON(&cr); err != nil || cr.Reply == nil || cr.Reply.Id != "6" {
+		t.Fatalf("blocked request got %+v %v", cr, err)
+	}
+	if r := call(c, "8", "sum", "[1,2]"); r.Status != CommStatusOK {
+		t.Fatalf("sum after the blocked request replied %+v", r)
+	}
+
+	// a connection must register first
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+	anon, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	if r := call(anon, "9", "sum", "[1,2]"); r.Code != CodeNotRegistered {
+		t.Fatalf("unregistered request replied %+v", r)
+	}
+}
+
+func Test_Server_Hooks(t *testing.T) {
+	events := make(chan string, 16)
+
+	s := NewServer("")
+	s.AuthToken = func(token string) (string, bool) {
+		return token, token != "bad"
+	}
+	s.OnConnect = func(conn *Conn, r *http.Request) {
+		events <- "connect " + r.URL.Query().Get("app")
+	}
+	s.OnRegister = func(conn *Conn, userID string, err error) {
+		events <- fmt.Sprintf("register %q %v", userID, err != nil)
+	}
+	s.OnMessage = func(conn *Conn, messageType int, data []byte) {
+		events <- fmt.Sprintf("message %d", messageType)
+	}
+	s.OnClose = func(conn *Conn, code int, reason string) {
+		events <- fmt.Sprintf("close %d %s", code, reason)
+	}
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath + "?app=test"
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, token := range []string{"alice", "bad"} {
+		rm, _ := json.Marshal(RegisterMessage{Token: token})
+		c.WriteJSON(WSMessage{Kind: RegisterMessageType, Body: rm})
+	}
+	c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "bye"))
+
+	want := []string{
+		"connect test",
+		"message 1",
+		`register "alice" false`,
+		"message 1",
+		`register "" true`,
+		"close 4000 bye",
+	}
+	for _, w := range want {
+		select {
+		case got := <-events:
+			if got != w {
+				t.Fatalf("got hook %q, want %q", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("hook %q not called", w)
+		}
+	}
+}
+
+func Test_Server_MaxMessageSize(t *testing.T) {
+	closed := make(chan int, 1)
+
+	s := NewServer("")
+	s.MaxMessageSize = 1024
+	s.OnClose = func(conn *Conn, code int, reason string) {
+		closed <- code
+	}
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	c := dialAndRegister(t, s, ts, uuid.New().String(), "")
+	defer c.Close()
+
+	c.WriteMessage(websocket.BinaryMessage, bytes.Repeat([]byte{0x91}, 2048))
+	_, _, err := c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("read after a message too big: %v", err)
+	}
+	select {
+	case code := <-closed:
+		if code != websocket.CloseMessageTooBig {
+			t.Fatalf("OnClose got code %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called")
+	}
+
+	// nested beyond the limit, as if the message was not limited
+	err = MsgPackCodec{}.Unmarshal(bytes.Repeat([]byte{0x91}, 1<<20), &WSMessage{})
+	if err == nil || !strings.Contains(err.Error(), "max depth") {
+		t.Fatalf("decode deeply nested msgpack: %v", err)
+	}
+}
+
+func Test_Server_Register(t *testing.T) {
+	s := NewServer("")
+	s.RegisterTimeout = 100 * time.Millisecond
+	s.AuthToken = func(token string) (string, bool) {
+		return token, token != "bad"
+	}
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+	dial := func() *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		return c
+	}
+	register := func(c *websocket.Conn, token string) *RegisterResult {
+		rm, _ := json.Marshal(RegisterMessage{Token: token, Version: ProtocolVersion2})
+		c.WriteJSON(WSMessage{Kind: RegisterMessageType, Body: rm})
+		var cr CommRequest
+		if err := c.ReadJSON(&cr); err != nil || cr.Register == nil {
+			t.Fatalf("register %s: %+v %v", token, cr, err)
+		}
+		return cr.Register
+	}
+	// closed waits for the close frame of the server
+	closed := func(c *websocket.Conn, reason string) {
+		for {
+			_, _, err := c.ReadMessage()
+			if err == nil {
+				continue
+			}
+			ce, ok := err.(*websocket.CloseError)
+			if !ok || ce.Code != websocket.ClosePolicyViolation || ce.Text != reason {
+				t.Fatalf("closed with %v, want %s", err, reason)
+			}
+			return
+		}
+	}
+
+	c := dial()
+	defer c.Close()
+	if r := register(c, "alice"); r.Status != CommStatusOK || r.UserID != "alice" {
+		t.Fatalf("register replied %+v", r)
+	}
+	// registered in time, it's kept open
+	time.Sleep(200 * time.Millisecond)
+	if found, _ := s.wh.cm.hasUser("alice"); !found {
+		t.Fatal("registered connection closed")
+	}
+
+	bad := dial()
+	defer bad.Close()
+	if r := register(bad, "bad"); r.Status != CommStatusError || r.Code != CodeInvalidToken {
+		t.Fatalf("register with bad token replied %+v", r)
+	}
+	closed(bad, CodeInvalidToken)
+
+	late := dial()
+	defer late.Close()
+	closed(late, CodeRegisterTimeout)
+
+	// responding before registering
+	rude := dial()
+	defer rude.Close()
+	cr, _ := json.Marshal(CommResponse{Id: "1", Msg: jsonString("hi")})
+	rude.WriteJSON(WSMessage{Kind: NormalMessageType, Body: cr})
+	closed(rude, CodeNotRegistered)
+}
+
+func Test_Server_AuthRequest(t *testing.T) {
+	s := NewServer("")
+	s.MaxConnsPerUser = 1
+	closed := make(chan string, 4)
+	s.OnClose = func(conn *Conn, code int, reason string) {
+		closed <- fmt.Sprintf("%d %s", code, reason)
+	}
+	s.AuthRequest = func(r *http.Request) (string, map[string]interface{}, error) {
+		c, err := r.Cookie("session")
+		if err != nil {
+			return "", nil, err
+		}
+		if c.Value == "banned" {
+			return "", nil, ErrForbidden
+		}
+		return c.Value, map[string]interface{}{"role": "admin"}, nil
+	}
+	s.Handle("role", func(ctx context.Context, req *Request) (json.RawMessage, error) {
+		return json.Marshal(req.Conn.Claims()["role"])
+	})
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath
+	dial := func(session string) (*websocket.Conn, int) {
+		h := http.Header{}
+		if session != "" {
+			h.Set("Cookie", "session="+session)
+		}
+		c, resp, err := websocket.DefaultDialer.Dial(url+"?version=2", h)
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		return c, resp.StatusCode
+	}
+
+	if _, status := dial(""); status != http.StatusUnauthorized {
+		t.Fatalf("dial without session: %d", status)
+	}
+	if _, status := dial("banned"); status != http.StatusForbidden {
+		t.Fatalf("dial with banned session: %d", status)
+	}
+
+	// registered without the register message
+	userID := uuid.New().String()
+	c, _ := dial(userID)
+	if c == nil {
+		t.Fatal("dial with session failed")
+	}
+	defer c.Close()
+	waitConns(t, s, userID, 1)
+
+	body, _ := json.Marshal(Request{Id: "1", Method: "role"})
+	c.WriteJSON(WSMessage{Kind: RequestMessageType, Body: body})
+	var cr CommRequest
+	if err := c.ReadJSON(&cr); err != nil || cr.Reply == nil || string(cr.Reply.Result) != `"admin"` {
+		t.Fatalf("claims replied %+v: %v", cr.Reply, err)
+	}
+
+	// the upgrade request can't be presented again
+	body, _ = json.Marshal(ReauthMessage{Token: userID})
+	c.WriteJSON(WSMessage{Kind: ReauthMessageType, Body: body})
+	cr = CommRequest{}
+	if err := c.ReadJSON(&cr); err != nil || cr.Auth == nil || cr.Auth.Code != CodeUnauthorized {
+		t.Fatalf("reauth answered %+v: %v", cr.Auth, err)
+	}
+
+	// the version is given by the query
+	go func() {
+		var req CommRequest
+		if err := c.ReadJSON(&req); err != nil {
+			return
+		}
+		cr, _ := json.Marshal(CommResponse{Id: req.Id, Msg: req.Msg})
+		c.WriteJSON(WSMessage{Kind: NormalMessageType, Body: cr})
+	}()
+	resp, err := s.Call(context.Background(), userID, json.RawMessage(`{"a":1}`))
+	if err != nil || string(resp.Msg) != `{"a":1}` {
+		t.Fatalf("call replied %+v: %v", resp, err)
+	}
+
+	// failing to bind is closed like other connections
+	second, _ := dial(userID)
+	if second == nil {
+		t.Fatal("dial of the second connection failed")
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := second.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("second connection closed with %v", err)
+	}
+	select {
+	case got := <-closed:
+		if got != fmt.Sprintf("%d %s", websocket.ClosePolicyViolation, CodeAlreadyRegistered) {
+			t.Fatalf("OnClose got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called for the second connection")
+	}
+
+	// it can't reauthenticate, so it's not asked to
+	if n := s.Reauth(userID, time.Minute); n != 1 {
+		t.Fatalf("reauth asked %d connections", n)
+	}
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, p, err := c.ReadMessage(); err == nil {
+		t.Fatalf("told to reauthenticate without VerifyToken: %s", p)
+	}
+}
+
+func Test_Server_AuthRequestReauth(t *testing.T) {
+	s := NewServer("")
+	s.ReauthNotice = time.Hour
+	s.AuthRequest = func(r *http.Request) (string, map[string]interface{}, error) {
+		exp := time.Now().Add(time.Minute).Unix()
+		return r.URL.Query().Get("user"), map[string]interface{}{"exp": exp}, nil
+	}
+	s.VerifyToken = func(token string) (string, map[string]interface{}, error) {
+		if !strings.HasPrefix(token, "good:") {
+			return "", nil, ErrInvalidToken
+		}
+		return strings.TrimPrefix(token, "good:"), map[string]interface{}{"role": "renewed"}, nil
+	}
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + s.WSPath + "?version=2&user=" + userID
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+
+	// expiring within the notice, the client is told at once
+	var cr CommRequest
+	if err := c.ReadJSON(&cr); err != nil || cr.Auth == nil || cr.Auth.Status != AuthStatusExpiring {
+		t.Fatalf("expiring notice %+v: %v", cr.Auth, err)
+	}
+
+	// tokens are verified by VerifyToken
+	reauth := func(token string) *AuthStatus {
+		body, _ := json.Marshal(ReauthMessage{Token: token})
+		c.WriteJSON(WSMessage{Kind: ReauthMessageType, Body: body})
+		var cr CommRequest
+		if err := c.ReadJSON(&cr); err != nil || cr.Auth == nil {
+			t.Fatalf("reauth answered %+v: %v", cr.Auth, err)
+		}
+		return cr.Auth
+	}
+	if a := reauth("bad"); a.Status != CommStatusError || a.Code != CodeInvalidToken {
+		t.Fatalf("reauth with bad token answered %+v", a)
+	}
+	if a := reauth("good:" + userID); a.Status != CommStatusOK || a.Expires != 0 {
+		t.Fatalf("reauth answered %+v", a)
+	}
+	if role := s.wh.cm.conns(userID)[0].Claims()["role"]; role != "renewed" {
+		t.Fatalf("claims after reauth: %v", role)
+	}
+}
+
+func Test_Server_Reauth(t *testing.T) {
+	// tokens are taken as userIDs, they can't be verified
+	s := NewServer("")
+	ts := newTestServer(s)
+	defer ts.Close()
+
+	userID := uuid.New().String()
+	c := dialAndRegister(t, s, ts, userID, "")
+	defer c.Close()
+
+	if n := s.Reauth(userID, 300*time.Millisecond); n != 1 {
+		t.Fatalf("reauth asked %d connections", n)
+	}
+
+	body, _ := json.Marshal(ReauthMessage{Token: userID})
+	c.WriteJSON(WSMessage{Kind: ReauthMessageType, Body: body})
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	var cr CommRequest
+	if err := c.ReadJSON(&cr); err != nil || cr.Auth == nil || cr.Auth.Status != CommStatusError || cr.Auth.Code != CodeUnauthorized {
+		t.Fatalf("reauth with the userID answered %+v: %v", cr.Auth, err)
+	}
+
+	// still closed when the grace ends
+	_, _, err := c.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.ClosePolicyViolation || ce.Text != CodeTokenExpired {
+		t.Fatalf("closed with %v", err)
+	}
+}
+
+// newTestServer mounts handlers of s onto a httptest server.
+func newTestServer(s *Server) *httptest.Server {
+	h, err := s.Handler()
+	if err != nil {
+		panic(err)
+	}
+	return httptest.NewServer(h)
+}
+
+// dialAndRegister connects to ts and registers userID, it returns after the
+// server has bound the connection.
+func dialAndRegister(t *testing.T, s *Server, ts *httptest.Server, userID, event string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + serverDefaultWSPath
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rm, _ := json.Marshal(RegisterMessage{Token: userID, Event: event})
+	msg, _ := json.Marshal(WSMessage{Kind: RegisterMessageType, Body: rm})
+	if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if found, _ := s.wh.cm.hasUser(userID); found {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c
+}
+
+// echoCommands answers every command received by c with the command itself.
+func echoCommands(c *websocket.Conn) {
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		wsm, _ := json.Marshal(WSMessage{
+			Kind: NormalMessageType,
+			Body: message,
+		})
+		if err := c.WriteMessage(websocket.TextMessage, wsm); err != nil {
+			return
+		}
+	}
+}
+
+// waitConns waits until userID has n bound connections.
+func waitConns(t *testing.T, s *Server, userID string, n int) {
+	for i := 0; i < 100; i++ {
+		s.wh.cm.mu.RLock()
+		cc := s.wh.cm.userConnCommMap[userID]
+		got := 0
+		if cc != nil {
+			got = len(cc.conns)
+		}
+		s.wh.cm.mu.RUnlock()
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("user %s doesn't have %d connections", userID, n)
+}